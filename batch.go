@@ -0,0 +1,109 @@
+package hlsm
+
+import (
+	"context"
+	"errors"
+	"github.com/hlccd/hlsm/kv"
+	"sync/atomic"
+)
+
+// WriteBatch 批量写入,可跨越多个列族,写入时作为一条预写日志整体生效
+type WriteBatch struct {
+	values []*kv.Value
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{
+		values: make([]*kv.Value, 0),
+	}
+}
+
+// Insert 向批量写入中添加一条插入记录
+func (b *WriteBatch) Insert(f *Family, key string, value any) {
+	v := kv.NewValue(key, value, false)
+	v.Family = f.name
+	b.values = append(b.values, v)
+}
+
+// Erase 向批量写入中添加一条删除记录
+func (b *WriteBatch) Erase(f *Family, key string) {
+	v := kv.NewValue(key, nil, true)
+	v.Family = f.name
+	b.values = append(b.values, v)
+}
+
+// DeleteRange 向批量写入中添加一条范围删除记录,删除 [start, end) 内的所有key
+func (b *WriteBatch) DeleteRange(f *Family, start, end string) {
+	v := kv.NewValue(start, nil, true)
+	v.Family = f.name
+	v.End = end
+	b.values = append(b.values, v)
+}
+
+// Len 批量写入中的记录数
+func (b *WriteBatch) Len() int {
+	return len(b.values)
+}
+
+// Write 原子地执行批量写入
+func (lsm *HLsm) Write(b *WriteBatch) error {
+	if b == nil || len(b.values) == 0 {
+		return nil
+	}
+	lsm.stall()
+	lsm.Lock()
+	defer lsm.Unlock()
+	families := make([]*Family, len(b.values))
+	values := make([]*kv.Value, len(b.values))
+	for i, v := range b.values {
+		f, ok := lsm.families[v.Family]
+		if !ok {
+			return errors.New("列族不存在: " + v.Family)
+		}
+		if v.End != "" && v.Key >= v.End {
+			return errors.New("范围删除的起始key应小于结束key")
+		}
+		families[i] = f
+		values[i] = kv.NewValue(v.Key, v.Value, v.Deleted)
+		values[i].Family = f.walName()
+		values[i].End = v.End
+	}
+	lsm.log(values...)
+	flushed := false
+	for i, v := range values {
+		if families[i].apply(v) {
+			continue
+		}
+		// 缓存已满,落盘后将尚未生效的记录作为新日志的初始内容,保证整批记录仍然原子生效
+		lsm.flush(values[i:]...)
+		flushed = true
+		if !families[i].apply(v) {
+			return errors.New("写入缓存失败: " + v.Key)
+		}
+	}
+	if flushed {
+		// 区块压缩
+		lsm.afterFlush(context.Background())
+	}
+	return nil
+}
+
+// 将记录写入列族缓存,同时使读缓存中对应的记录失效
+func (f *Family) apply(v *kv.Value) bool {
+	atomic.AddUint64(&f.writeGen, 1)
+	if f.read != nil {
+		if v.End != "" {
+			f.read.EraseRange(v.Key, v.End)
+		} else {
+			f.read.Erase(v.Key)
+		}
+	}
+	if v.End != "" {
+		f.deleteRange(v.Key, v.End)
+		return true
+	}
+	if v.Deleted {
+		return f.cache.Erase(v.Key)
+	}
+	return f.cache.Insert(v.Key, v.Value)
+}
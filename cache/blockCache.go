@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"container/list"
+	"github.com/hlccd/hlsm/kv"
+	"sync"
+	"unsafe"
+)
+
+// 每个数据块除数据外的固定开销
+var blockEntryOverhead = int64(unsafe.Sizeof(list.Element{})+unsafe.Sizeof(blockEntry{})+unsafe.Sizeof(kv.Value{})) + pointerSize + mapEntryExtra
+
+// BlockKey 数据块的定位,File 为 SSTable 打开时分配的编号,不会重复使用
+type BlockKey struct {
+	File   uint64
+	Offset int64
+}
+
+type blockEntry struct {
+	key   BlockKey
+	value *kv.Value // 解码后的元素
+	size  int64
+	level int // 所属 SSTable 的层级,用于统计
+	pins  int // 正在使用的次数,大于 0 时不会被淘汰
+}
+
+// BlockHandle 从块缓存中取得的数据块,使用期间不会被淘汰,用完后需调用 Release
+type BlockHandle struct {
+	c *BlockCache
+	e *blockEntry
+}
+
+// Value 解码后的元素,调用方不应修改
+func (h *BlockHandle) Value() *kv.Value {
+	return h.e.value
+}
+
+// Release 解除对数据块的占用
+func (h *BlockHandle) Release() {
+	if h == nil {
+		return
+	}
+	h.c.Lock()
+	h.e.pins--
+	h.c.Unlock()
+}
+
+// BlockCache 多个区块树共享的块缓存,缓存从 SSTable 数据区读取并解码后的元素,
+// 容量不足时淘汰最久未被访问且未被占用的数据块
+type BlockCache struct {
+	len   int64                              // 当前容量,即所有数据块在文件中的长度及固定开销之和
+	cap   int64                              // 容量上限
+	ll    *list.List                         // 越靠近首部越近被访问
+	cache map[BlockKey]*list.Element         // 数据块与链表元素的映射表
+	files map[uint64]map[int64]*list.Element // 每个文件已缓存的数据块,文件删除时一并移除
+	stats map[int]*Stats                     // 各层的命中统计
+	sync.Mutex
+}
+
+func NewBlockCache(cap int64) *BlockCache {
+	return &BlockCache{
+		cap:   cap,
+		ll:    list.New(),
+		cache: make(map[BlockKey]*list.Element),
+		files: make(map[uint64]map[int64]*list.Element),
+		stats: make(map[int]*Stats),
+	}
+}
+
+func (c *BlockCache) levelStats(level int) *Stats {
+	s, ok := c.stats[level]
+	if !ok {
+		s = &Stats{}
+		c.stats[level] = s
+	}
+	return s
+}
+
+// Lookup 查找数据块并占用,level 为查找方所在层级,仅用于统计
+func (c *BlockCache) Lookup(key BlockKey, level int) (*BlockHandle, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.Lock()
+	defer c.Unlock()
+	ele, ok := c.cache[key]
+	if !ok {
+		c.levelStats(level).Misses++
+		return nil, false
+	}
+	c.levelStats(level).Hits++
+	c.ll.MoveToFront(ele)
+	e := ele.Value.(*blockEntry)
+	e.pins++
+	return &BlockHandle{c: c, e: e}, true
+}
+
+// Insert 放入数据块并占用,size 为数据块在文件中的长度,已存在时返回已有的数据块
+func (c *BlockCache) Insert(key BlockKey, level int, value *kv.Value, size int64) *BlockHandle {
+	if c == nil {
+		return nil
+	}
+	c.Lock()
+	defer c.Unlock()
+	if ele, ok := c.cache[key]; ok {
+		c.ll.MoveToFront(ele)
+		e := ele.Value.(*blockEntry)
+		e.pins++
+		return &BlockHandle{c: c, e: e}
+	}
+	e := &blockEntry{
+		key:   key,
+		value: value,
+		size:  size + blockEntryOverhead,
+		level: level,
+		pins:  1,
+	}
+	ele := c.ll.PushFront(e)
+	c.cache[key] = ele
+	if c.files[key.File] == nil {
+		c.files[key.File] = make(map[int64]*list.Element)
+	}
+	c.files[key.File][key.Offset] = ele
+	c.len += e.size
+	// 从尾部开始淘汰未被占用的数据块,全部被占用时允许暂时超出容量
+	for back := c.ll.Back(); c.len > c.cap && back != nil; {
+		prev := back.Prev()
+		if old := back.Value.(*blockEntry); old.pins == 0 {
+			c.remove(back)
+			c.levelStats(old.level).Evictions++
+		}
+		back = prev
+	}
+	return &BlockHandle{c: c, e: e}
+}
+
+// EvictFile 移除文件的所有数据块,在 SSTable 关闭或删除时调用,已被占用的数据块在释放前仍可使用
+func (c *BlockCache) EvictFile(file uint64) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	for _, ele := range c.files[file] {
+		c.remove(ele)
+	}
+	delete(c.files, file)
+}
+
+// Size 当前估算的占用字节数
+func (c *BlockCache) Size() int64 {
+	if c == nil {
+		return 0
+	}
+	c.Lock()
+	defer c.Unlock()
+	return c.len
+}
+
+// Cap 配置的容量上限
+func (c *BlockCache) Cap() int64 {
+	if c == nil {
+		return 0
+	}
+	return c.cap
+}
+
+// Stats 各层的命中统计,key 为层级
+func (c *BlockCache) Stats() map[int]Stats {
+	stats := make(map[int]Stats)
+	if c == nil {
+		return stats
+	}
+	c.Lock()
+	defer c.Unlock()
+	for level, s := range c.stats {
+		stats[level] = *s
+	}
+	return stats
+}
+
+// 移除链表元素,调用方需持有锁
+func (c *BlockCache) remove(ele *list.Element) {
+	e := ele.Value.(*blockEntry)
+	c.ll.Remove(ele)
+	delete(c.cache, e.key)
+	if blocks := c.files[e.key.File]; blocks != nil {
+		delete(blocks, e.key.Offset)
+		if len(blocks) == 0 {
+			delete(c.files, e.key.File)
+		}
+	}
+	c.len -= e.size
+}
@@ -8,21 +8,30 @@ import (
 )
 
 type lru struct {
-	len          int64                    // 当前容量
+	len          int64                    // 当前容量,即所有记录的 key、value 及每条记录固定开销的估算字节数
 	cap          int64                    // 容量上限,增删时会判断是否到达容量上限,到达后会增删失败,此时应当将缓存设为区块进行持久化
 	ll           *list.List               // 用于存储的链表
 	cache        map[string]*list.Element // 链表元素与key的映射表
+	sizer        Sizer                    // value 大小的估算方式
 	sync.RWMutex                          // 并发控制锁
 }
 
 func NewLRU(cap int64) *lru {
+	return NewLRUWithSizer(cap, DeepSizer{})
+}
+
+// NewLRUWithSizer 以指定的 value 大小估算方式创建
+func NewLRUWithSizer(cap int64, sizer Sizer) *lru {
 	return &lru{
 		len:   0,
 		cap:   cap,
 		ll:    list.New(),
 		cache: make(map[string]*list.Element),
+		sizer: sizer,
 	}
 }
+
+// Size 当前估算的占用字节数
 func (l *lru) Size() int64 {
 	if l == nil {
 		return 0
@@ -32,6 +41,14 @@ func (l *lru) Size() int64 {
 	return l.len
 }
 
+// Cap 配置的容量上限
+func (l *lru) Cap() int64 {
+	if l == nil {
+		return 0
+	}
+	return l.cap
+}
+
 // Insert 将对应的key进行插入,若已有进行替换即可
 func (l *lru) Insert(key string, value any) bool {
 	if l == nil {
@@ -64,17 +81,19 @@ func (l *lru) insert(key string, value any, deleted bool) bool {
 		v := ele.Value.(*kv.Value)
 		v.Deleted = deleted
 		//此处是一个替换,即将cache中的value替换为新的value,同时根据实际存储量修改其当前存储的实际大小
-		if l.cap >= l.len+size(value)-size(v.Value) {
+		diff := l.sizer.Size(value) - l.sizer.Size(v.Value)
+		if l.cap >= l.len+diff {
 			// 仍有空间进行插入
-			l.len += size(value) - size(v.Value)
+			l.len += diff
 			v.Value = value
 			return true
 		}
 	} else {
 		//此处是一个增加操作,即原本不存在,所以直接插入即可,同时在当前数值范围内增加对应的占用空间
-		if l.cap >= l.len+size(key)+size(value) {
+		add := int64(len(key)) + l.sizer.Size(value) + lruEntryOverhead
+		if l.cap >= l.len+add {
 			// 仍有空间进行插入
-			l.len += size(key) + size(value)
+			l.len += add
 			//该key不存在,需要进行插入
 			l.cache[key] = l.ll.PushFront(kv.NewValue(key, value, deleted))
 			return true
@@ -94,8 +113,9 @@ func (l *lru) Get(key string) (value any, ok bool) {
 	if l == nil {
 		return nil, false
 	}
-	l.RLock()
-	defer l.RUnlock()
+	// 调整链表位置属于写操作,不能只持有读锁
+	l.Lock()
+	defer l.Unlock()
 	if ele, ok := l.cache[key]; ok {
 		//找到了value,将其移到链表首部
 		l.ll.MoveToFront(ele)
@@ -104,6 +124,65 @@ func (l *lru) Get(key string) (value any, ok bool) {
 	return nil, false
 }
 
+// Find 查找key对应的记录,包含已被标记删除的记录,不改变其在链表中的位置
+func (l *lru) Find(key string) (value *kv.Value, ok bool) {
+	if l == nil {
+		return nil, false
+	}
+	l.RLock()
+	defer l.RUnlock()
+	if ele, ok := l.cache[key]; ok {
+		v := *ele.Value.(*kv.Value)
+		return &v, true
+	}
+	return nil, false
+}
+
+// EraseRange 将 [start, end) 内已存在的key全部标记为删除,返回标记的数量
+// 删除只会缩小或基本不改变占用空间,故不受容量上限限制
+func (l *lru) EraseRange(start, end string) int {
+	if l == nil {
+		return 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	count := 0
+	for k, ele := range l.cache {
+		if k < start || k >= end {
+			continue
+		}
+		v := ele.Value.(*kv.Value)
+		if !v.Deleted {
+			l.len -= l.sizer.Size(v.Value)
+			v.Value = nil
+			v.Deleted = true
+			count++
+		}
+	}
+	return count
+}
+
+// Scan 按 key 升序获取 [start, end) 内所有记录的副本,包含已被标记删除的记录,end 为空时表示不设上限
+func (l *lru) Scan(start, end string) []*kv.Value {
+	if l == nil {
+		return nil
+	}
+	l.RLock()
+	defer l.RUnlock()
+	values := make([]*kv.Value, 0)
+	for k, ele := range l.cache {
+		if k < start || (end != "" && k >= end) {
+			continue
+		}
+		v := *ele.Value.(*kv.Value)
+		values = append(values, &v)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].Key < values[j].Key
+	})
+	return values
+}
+
 func (l *lru) ClearAndGainSorted() []*kv.Value {
 	if l == nil {
 		return nil
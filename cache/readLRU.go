@@ -0,0 +1,262 @@
+package cache
+
+import (
+	"container/list"
+	"github.com/hlccd/hlsm/kv"
+	"sort"
+	"sync"
+)
+
+// Stats 读缓存的命中统计
+type Stats struct {
+	Hits      uint64 // 命中次数
+	Misses    uint64 // 未命中次数
+	Evictions uint64 // 因容量不足被淘汰的记录数
+}
+
+// HitRatio 命中率
+func (s Stats) HitRatio() float64 {
+	if s.Hits+s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits+s.Misses)
+}
+
+// StatsReporter 可提供命中统计的缓存
+type StatsReporter interface {
+	Stats() Stats
+}
+
+// OnEvict 记录因容量不足被淘汰时的回调,在释放锁后调用
+type OnEvict func(key string, value any)
+
+// readLRU 用作读缓存的 LRU,容量不足时淘汰最久未被访问的记录,
+// 被淘汰的记录仍存在于区块中,故不可用作缓存区
+type readLRU struct {
+	len        int64                    // 当前容量,即所有记录的 key、value 及每条记录固定开销的估算字节数
+	cap        int64                    // 容量上限,超过后从链表尾部开始淘汰
+	ll         *list.List               // 用于存储的链表,越靠近首部越近被访问
+	cache      map[string]*list.Element // 链表元素与key的映射表
+	sizer      Sizer                    // value 大小的估算方式
+	onEvict    OnEvict                  // 淘汰回调
+	stats      Stats                    // 命中统计
+	sync.Mutex                          // 并发控制锁,查找时也会调整链表,故只能使用互斥锁
+}
+
+func NewReadLRU(cap int64, onEvict OnEvict) *readLRU {
+	return NewReadLRUWithSizer(cap, DeepSizer{}, onEvict)
+}
+
+// NewReadLRUWithSizer 以指定的 value 大小估算方式创建
+func NewReadLRUWithSizer(cap int64, sizer Sizer, onEvict OnEvict) *readLRU {
+	return &readLRU{
+		cap:     cap,
+		ll:      list.New(),
+		cache:   make(map[string]*list.Element),
+		sizer:   sizer,
+		onEvict: onEvict,
+	}
+}
+
+// Size 当前估算的占用字节数
+func (r *readLRU) Size() int64 {
+	if r == nil {
+		return 0
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.len
+}
+
+// Cap 配置的容量上限
+func (r *readLRU) Cap() int64 {
+	if r == nil {
+		return 0
+	}
+	return r.cap
+}
+
+// Stats 命中统计
+func (r *readLRU) Stats() Stats {
+	if r == nil {
+		return Stats{}
+	}
+	r.Lock()
+	defer r.Unlock()
+	return r.stats
+}
+
+// Insert 插入或替换记录,容量不足时淘汰最久未被访问的记录,单条记录超过容量上限时插入失败
+func (r *readLRU) Insert(key string, value any) bool {
+	if r == nil {
+		return false
+	}
+	r.Lock()
+	ok, evicted := r.insert(key, value)
+	r.Unlock()
+	r.evicted(evicted)
+	return ok
+}
+
+// Erase 读缓存中没有删除标记,直接移除该记录
+func (r *readLRU) Erase(key string) bool {
+	if r == nil {
+		return false
+	}
+	r.Lock()
+	defer r.Unlock()
+	if ele, ok := r.cache[key]; ok {
+		r.remove(ele)
+	}
+	return true
+}
+
+// Put 插入一组记录,删除标记对应的记录直接移除
+func (r *readLRU) Put(values []*kv.Value) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	evicted := make([]*kv.Value, 0)
+	for _, v := range values {
+		if v.Deleted {
+			if ele, ok := r.cache[v.Key]; ok {
+				r.remove(ele)
+			}
+			continue
+		}
+		_, e := r.insert(v.Key, v.Value)
+		evicted = append(evicted, e...)
+	}
+	r.Unlock()
+	r.evicted(evicted)
+}
+
+func (r *readLRU) Get(key string) (value any, ok bool) {
+	if v, ok := r.Find(key); ok {
+		return v.Value, true
+	}
+	return nil, false
+}
+
+// Find 查找记录并将其移到链表首部
+func (r *readLRU) Find(key string) (value *kv.Value, ok bool) {
+	if r == nil {
+		return nil, false
+	}
+	r.Lock()
+	defer r.Unlock()
+	if ele, ok := r.cache[key]; ok {
+		r.stats.Hits++
+		r.ll.MoveToFront(ele)
+		v := *ele.Value.(*kv.Value)
+		return &v, true
+	}
+	r.stats.Misses++
+	return nil, false
+}
+
+// EraseRange 移除 [start, end) 内的所有记录,返回移除的数量
+func (r *readLRU) EraseRange(start, end string) int {
+	if r == nil {
+		return 0
+	}
+	r.Lock()
+	defer r.Unlock()
+	count := 0
+	for k, ele := range r.cache {
+		if k >= start && k < end {
+			r.remove(ele)
+			count++
+		}
+	}
+	return count
+}
+
+// Scan 按 key 升序获取 [start, end) 内所有记录的副本,end 为空时表示不设上限
+func (r *readLRU) Scan(start, end string) []*kv.Value {
+	if r == nil {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	values := make([]*kv.Value, 0)
+	for k, ele := range r.cache {
+		if k < start || (end != "" && k >= end) {
+			continue
+		}
+		v := *ele.Value.(*kv.Value)
+		values = append(values, &v)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].Key < values[j].Key
+	})
+	return values
+}
+
+// ClearAndGainSorted 清空读缓存并按序返回原有的全部记录
+func (r *readLRU) ClearAndGainSorted() []*kv.Value {
+	if r == nil {
+		return nil
+	}
+	r.Lock()
+	defer r.Unlock()
+	values := make([]*kv.Value, 0, len(r.cache))
+	for _, ele := range r.cache {
+		values = append(values, ele.Value.(*kv.Value))
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].Key < values[j].Key
+	})
+	r.ll.Init()
+	r.cache = make(map[string]*list.Element)
+	r.len = 0
+	return values
+}
+
+// 插入记录并淘汰超出容量的记录,返回被淘汰的记录,调用方需持有锁
+func (r *readLRU) insert(key string, value any) (bool, []*kv.Value) {
+	add := int64(len(key)) + r.sizer.Size(value) + lruEntryOverhead
+	if add > r.cap {
+		if ele, ok := r.cache[key]; ok {
+			// 旧记录已失效,不能继续保留
+			r.remove(ele)
+		}
+		return false, nil
+	}
+	if ele, ok := r.cache[key]; ok {
+		r.ll.MoveToFront(ele)
+		v := ele.Value.(*kv.Value)
+		r.len += r.sizer.Size(value) - r.sizer.Size(v.Value)
+		v.Value = value
+	} else {
+		r.len += add
+		r.cache[key] = r.ll.PushFront(kv.NewValue(key, value, false))
+	}
+	evicted := make([]*kv.Value, 0)
+	for r.len > r.cap {
+		ele := r.ll.Back()
+		evicted = append(evicted, ele.Value.(*kv.Value))
+		r.remove(ele)
+		r.stats.Evictions++
+	}
+	return true, evicted
+}
+
+// 移除链表元素,调用方需持有锁
+func (r *readLRU) remove(ele *list.Element) {
+	v := ele.Value.(*kv.Value)
+	r.ll.Remove(ele)
+	delete(r.cache, v.Key)
+	r.len -= int64(len(v.Key)) + r.sizer.Size(v.Value) + lruEntryOverhead
+}
+
+// 在锁外调用淘汰回调
+func (r *readLRU) evicted(values []*kv.Value) {
+	if r.onEvict == nil {
+		return
+	}
+	for _, v := range values {
+		r.onEvict(v.Key, v.Value)
+	}
+}
@@ -0,0 +1,200 @@
+package cache
+
+import (
+	"container/heap"
+	"github.com/hlccd/hlsm/kv"
+)
+
+// sharded 将 key 按哈希分散到多个各自加锁的缓存中,减少并发读写时的锁竞争,
+// 可用作缓存区或读缓存,每个分片的容量上限为总容量的 1/n,用作缓存区时任一分片写满即需落盘
+type sharded struct {
+	cap    int64   // 容量上限
+	shards []Cache // 分片
+	mask   uint32  // 分片数量为 2 的幂,以掩码取模
+}
+
+// NewSharded 创建 n 个分片的缓存,n 会向上取整为 2 的幂,newShard 以每个分片的容量创建分片
+func NewSharded(n int, cap int64, newShard func(cap int64) Cache) *sharded {
+	size := 1
+	for size < n {
+		size <<= 1
+	}
+	s := &sharded{
+		cap:    cap,
+		shards: make([]Cache, size),
+		mask:   uint32(size - 1),
+	}
+	for i := range s.shards {
+		s.shards[i] = newShard(cap / int64(size))
+	}
+	return s
+}
+
+// fnv-1a,不产生内存分配
+func shardHash(key string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return h
+}
+
+func (s *sharded) shard(key string) Cache {
+	return s.shards[shardHash(key)&s.mask]
+}
+
+// Size 所有分片估算的占用字节数之和
+func (s *sharded) Size() int64 {
+	if s == nil {
+		return 0
+	}
+	size := int64(0)
+	for _, c := range s.shards {
+		size += c.Size()
+	}
+	return size
+}
+
+// Cap 配置的容量上限
+func (s *sharded) Cap() int64 {
+	if s == nil {
+		return 0
+	}
+	return s.cap
+}
+
+// Stats 所有分片命中统计之和,分片不提供统计时为空
+func (s *sharded) Stats() Stats {
+	var stats Stats
+	if s == nil {
+		return stats
+	}
+	for _, c := range s.shards {
+		if r, ok := c.(StatsReporter); ok {
+			st := r.Stats()
+			stats.Hits += st.Hits
+			stats.Misses += st.Misses
+			stats.Evictions += st.Evictions
+		}
+	}
+	return stats
+}
+
+func (s *sharded) Insert(key string, value any) bool {
+	if s == nil {
+		return false
+	}
+	return s.shard(key).Insert(key, value)
+}
+
+func (s *sharded) Erase(key string) bool {
+	if s == nil {
+		return false
+	}
+	return s.shard(key).Erase(key)
+}
+
+// Put 将记录按分片分组后分别写入
+func (s *sharded) Put(values []*kv.Value) {
+	if s == nil {
+		return
+	}
+	groups := make([][]*kv.Value, len(s.shards))
+	for _, v := range values {
+		i := shardHash(v.Key) & s.mask
+		groups[i] = append(groups[i], v)
+	}
+	for i, g := range groups {
+		if len(g) > 0 {
+			s.shards[i].Put(g)
+		}
+	}
+}
+
+func (s *sharded) Get(key string) (value any, ok bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.shard(key).Get(key)
+}
+
+func (s *sharded) Find(key string) (value *kv.Value, ok bool) {
+	if s == nil {
+		return nil, false
+	}
+	return s.shard(key).Find(key)
+}
+
+// EraseRange 范围内的 key 分散在所有分片中,需逐个处理
+func (s *sharded) EraseRange(start, end string) int {
+	if s == nil {
+		return 0
+	}
+	count := 0
+	for _, c := range s.shards {
+		count += c.EraseRange(start, end)
+	}
+	return count
+}
+
+// Scan 归并所有分片的有序结果
+func (s *sharded) Scan(start, end string) []*kv.Value {
+	if s == nil {
+		return nil
+	}
+	lists := make([][]*kv.Value, len(s.shards))
+	for i, c := range s.shards {
+		lists[i] = c.Scan(start, end)
+	}
+	return mergeSorted(lists)
+}
+
+// ClearAndGainSorted 清空所有分片,并将各分片的有序结果归并为一个全局有序的列表
+func (s *sharded) ClearAndGainSorted() []*kv.Value {
+	if s == nil {
+		return nil
+	}
+	lists := make([][]*kv.Value, len(s.shards))
+	for i, c := range s.shards {
+		lists[i] = c.ClearAndGainSorted()
+	}
+	return mergeSorted(lists)
+}
+
+// 多路归并的堆,每个元素为一个列表剩余的部分
+type sortedLists [][]*kv.Value
+
+func (h sortedLists) Len() int           { return len(h) }
+func (h sortedLists) Less(i, j int) bool { return h[i][0].Key < h[j][0].Key }
+func (h sortedLists) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *sortedLists) Push(x any)        { *h = append(*h, x.([]*kv.Value)) }
+func (h *sortedLists) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// 将多个按 key 升序且 key 互不相同的列表归并为一个有序列表
+func mergeSorted(lists [][]*kv.Value) []*kv.Value {
+	total := 0
+	h := make(sortedLists, 0, len(lists))
+	for _, l := range lists {
+		if len(l) > 0 {
+			total += len(l)
+			h = append(h, l)
+		}
+	}
+	heap.Init(&h)
+	values := make([]*kv.Value, 0, total)
+	for h.Len() > 0 {
+		values = append(values, h[0][0])
+		if h[0] = h[0][1:]; len(h[0]) == 0 {
+			heap.Pop(&h)
+		} else {
+			heap.Fix(&h, 0)
+		}
+	}
+	return values
+}
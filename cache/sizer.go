@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"container/list"
+	"encoding/json"
+	"github.com/hlccd/hlsm/kv"
+	"reflect"
+	"unsafe"
+)
+
+const (
+	stringHeader  = int64(unsafe.Sizeof(""))
+	sliceHeader   = int64(unsafe.Sizeof([]byte(nil)))
+	pointerSize   = int64(unsafe.Sizeof(uintptr(0)))
+	mapHeader     = 48 // runtime.hmap 的大致大小
+	mapEntryExtra = 2  // 每个映射表元素在桶中额外占用的字节数(tophash 及溢出)
+)
+
+// 每条记录除 key 和 value 外的固定开销
+var (
+	// lru: 链表元素、记录结构体以及映射表中的一个 string 到指针的元素
+	lruEntryOverhead = int64(unsafe.Sizeof(list.Element{})+unsafe.Sizeof(kv.Value{})) + stringHeader + pointerSize + mapEntryExtra
+	// 跳表: 节点结构体、记录结构体以及平均约 4/3 个后继指针
+	skipEntryOverhead = int64(unsafe.Sizeof(skipNode{})+unsafe.Sizeof(kv.Value{})) + pointerSize*4/3
+)
+
+// Sizer 估算记录中 value 所占用的字节数
+type Sizer interface {
+	Size(value any) int64
+}
+
+// EncodedSizer 以 value 编码后写入磁盘的长度作为其大小,与区块大小一致,但每次估算都需要编码
+type EncodedSizer struct{}
+
+func (EncodedSizer) Size(value any) int64 {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return DeepSizer{}.Size(value)
+	}
+	return int64(len(data))
+}
+
+// DeepSizer 通过反射递归估算 value 实际占用的内存,常见类型不经过反射
+type DeepSizer struct{}
+
+func (DeepSizer) Size(value any) int64 {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case string:
+		return stringHeader + int64(len(v))
+	case []byte:
+		return sliceHeader + int64(cap(v))
+	case bool, int8, uint8:
+		return 1
+	case int16, uint16:
+		return 2
+	case int32, uint32, float32:
+		return 4
+	case int, uint, int64, uint64, float64, uintptr:
+		return 8
+	}
+	return deepSize(reflect.ValueOf(value), make(map[uintptr]bool))
+}
+
+// 递归估算,visited 记录已计算过的指针,避免重复计算共享数据及循环引用
+func deepSize(v reflect.Value, visited map[uintptr]bool) int64 {
+	if !v.IsValid() {
+		return 0
+	}
+	t := v.Type()
+	size := int64(t.Size())
+	switch v.Kind() {
+	case reflect.String:
+		size += int64(v.Len())
+	case reflect.Slice:
+		if v.IsNil() || visited[v.Pointer()] {
+			break
+		}
+		visited[v.Pointer()] = true
+		size += int64(v.Cap()-v.Len()) * int64(t.Elem().Size())
+		for i := 0; i < v.Len(); i++ {
+			size += deepSize(v.Index(i), visited)
+		}
+	case reflect.Array:
+		size = 0
+		for i := 0; i < v.Len(); i++ {
+			size += deepSize(v.Index(i), visited)
+		}
+	case reflect.Map:
+		if v.IsNil() || visited[v.Pointer()] {
+			break
+		}
+		visited[v.Pointer()] = true
+		size += mapHeader
+		it := v.MapRange()
+		for it.Next() {
+			size += deepSize(it.Key(), visited) + deepSize(it.Value(), visited) + mapEntryExtra
+		}
+	case reflect.Ptr:
+		if v.IsNil() || visited[v.Pointer()] {
+			break
+		}
+		visited[v.Pointer()] = true
+		size += deepSize(v.Elem(), visited)
+	case reflect.Interface:
+		if !v.IsNil() {
+			size += deepSize(v.Elem(), visited)
+		}
+	case reflect.Struct:
+		// 字段自身的大小已包含在结构体中,只需加上各字段引用的数据
+		for i := 0; i < v.NumField(); i++ {
+			size += deepSize(v.Field(i), visited) - int64(v.Field(i).Type().Size())
+		}
+	}
+	return size
+}
@@ -0,0 +1,89 @@
+package cache
+
+import "hash/fnv"
+
+const (
+	sketchDepth   = 4  // 哈希函数数量,即计数器行数
+	sketchMaxFreq = 15 // 计数器上限,超过后不再增长
+	sketchSample  = 10 // 累计增长次数达到 宽度*sketchSample 后所有计数器减半,使旧的热度逐渐衰减
+)
+
+// countMinSketch 以少量内存估算 key 的访问频率,估算值只会偏大不会偏小
+type countMinSketch struct {
+	rows  [sketchDepth][]uint8 // 计数器
+	mask  uint64               // 宽度为 2 的幂,以掩码取模
+	added int                  // 自上次衰减后的增长次数
+	limit int                  // 触发衰减的增长次数
+}
+
+// 创建宽度不小于 width 的 sketch
+func newCountMinSketch(width int) *countMinSketch {
+	w := 64
+	for w < width {
+		w <<= 1
+	}
+	s := &countMinSketch{
+		mask:  uint64(w - 1),
+		limit: w * sketchSample,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, w)
+	}
+	return s
+}
+
+// 由一个 64 位哈希派生出各行的下标
+func (s *countMinSketch) indexes(key string) [sketchDepth]uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum, sum>>32|sum<<32
+	var idx [sketchDepth]uint64
+	for i := range idx {
+		idx[i] = (h1 + uint64(i)*h2) & s.mask
+	}
+	return idx
+}
+
+// 增加一次访问,只增长各行中最小的计数器
+func (s *countMinSketch) increment(key string) {
+	idx := s.indexes(key)
+	min := s.estimateIndexes(idx)
+	if min >= sketchMaxFreq {
+		return
+	}
+	for i, j := range idx {
+		if s.rows[i][j] == min {
+			s.rows[i][j]++
+		}
+	}
+	s.added++
+	if s.added >= s.limit {
+		s.reset()
+	}
+}
+
+// 估算访问频率
+func (s *countMinSketch) estimate(key string) uint8 {
+	return s.estimateIndexes(s.indexes(key))
+}
+
+func (s *countMinSketch) estimateIndexes(idx [sketchDepth]uint64) uint8 {
+	min := uint8(sketchMaxFreq)
+	for i, j := range idx {
+		if s.rows[i][j] < min {
+			min = s.rows[i][j]
+		}
+	}
+	return min
+}
+
+// 所有计数器减半
+func (s *countMinSketch) reset() {
+	for i := range s.rows {
+		for j := range s.rows[i] {
+			s.rows[i][j] >>= 1
+		}
+	}
+	s.added /= 2
+}
@@ -0,0 +1,298 @@
+package cache
+
+import (
+	"github.com/hlccd/hlsm/kv"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const (
+	maxHeight = 12 // 跳表最大层数
+	branching = 4  // 每向上一层节点数量约缩小为 1/branching
+)
+
+// 跳表节点,插入后 key 不再改变,记录与后继节点均以原子操作读写
+type skipNode struct {
+	key   string
+	value unsafe.Pointer   // *kv.Value,替换时整体换成新的记录,不在原记录上修改
+	next  []unsafe.Pointer // *skipNode,每层的后继节点
+}
+
+func newSkipNode(key string, value *kv.Value, height int) *skipNode {
+	return &skipNode{
+		key:   key,
+		value: unsafe.Pointer(value),
+		next:  make([]unsafe.Pointer, height),
+	}
+}
+
+func (n *skipNode) loadNext(level int) *skipNode {
+	return (*skipNode)(atomic.LoadPointer(&n.next[level]))
+}
+
+func (n *skipNode) storeNext(level int, next *skipNode) {
+	atomic.StorePointer(&n.next[level], unsafe.Pointer(next))
+}
+
+func (n *skipNode) loadValue() *kv.Value {
+	return (*kv.Value)(atomic.LoadPointer(&n.value))
+}
+
+func (n *skipNode) storeValue(value *kv.Value) {
+	atomic.StorePointer(&n.value, unsafe.Pointer(value))
+}
+
+// 跳表的一份完整内容,落盘时整体替换为新的空内容,正在读取旧内容的读者不受影响
+type skipState struct {
+	head   *skipNode // 头节点,不存储数据
+	height int32     // 当前最高层数
+	len    int64     // 当前容量
+}
+
+func newSkipState() *skipState {
+	return &skipState{
+		head:   newSkipNode("", nil, maxHeight),
+		height: 1,
+	}
+}
+
+// skipList 并发跳表,key 始终有序,读操作无锁,写操作之间互斥
+type skipList struct {
+	cap        int64          // 容量上限,增删时会判断是否到达容量上限,到达后会增删失败,此时应当将缓存设为区块进行持久化
+	state      unsafe.Pointer // *skipState
+	rnd        *rand.Rand     // 随机层数,只在持有写锁时使用
+	sizer      Sizer          // value 大小的估算方式
+	sync.Mutex                // 写操作的并发控制锁
+}
+
+func NewSkipList(cap int64) *skipList {
+	return NewSkipListWithSizer(cap, DeepSizer{})
+}
+
+// NewSkipListWithSizer 以指定的 value 大小估算方式创建
+func NewSkipListWithSizer(cap int64, sizer Sizer) *skipList {
+	return &skipList{
+		cap:   cap,
+		state: unsafe.Pointer(newSkipState()),
+		rnd:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		sizer: sizer,
+	}
+}
+
+func (s *skipList) load() *skipState {
+	return (*skipState)(atomic.LoadPointer(&s.state))
+}
+
+func (s *skipList) randomHeight() int {
+	h := 1
+	for h < maxHeight && s.rnd.Intn(branching) == 0 {
+		h++
+	}
+	return h
+}
+
+// 查找第一个 key 不小于给定 key 的节点,prev 不为空时记录每层的前驱节点
+func (st *skipState) seek(key string, prev []*skipNode) *skipNode {
+	x := st.head
+	for level := int(atomic.LoadInt32(&st.height)) - 1; level >= 0; level-- {
+		next := x.loadNext(level)
+		for next != nil && next.key < key {
+			x = next
+			next = x.loadNext(level)
+		}
+		if prev != nil {
+			prev[level] = x
+		}
+	}
+	return x.loadNext(0)
+}
+
+// Size 当前估算的占用字节数
+func (s *skipList) Size() int64 {
+	if s == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&s.load().len)
+}
+
+// Cap 配置的容量上限
+func (s *skipList) Cap() int64 {
+	if s == nil {
+		return 0
+	}
+	return s.cap
+}
+
+// Insert 将对应的key进行插入,若已有进行替换即可
+func (s *skipList) Insert(key string, value any) bool {
+	if s == nil {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.insert(key, value, false)
+}
+
+// Erase 将对应的key标记为删除,若不存在则新建
+func (s *skipList) Erase(key string) bool {
+	if s == nil {
+		return false
+	}
+	s.Lock()
+	defer s.Unlock()
+	return s.insert(key, nil, true)
+}
+
+// 向跳表中插入数据,调用方需持有写锁
+// 新节点先链好自身的后继再由低到高挂入各层,读者在任意时刻看到的都是一个完整的跳表
+func (s *skipList) insert(key string, value any, deleted bool) bool {
+	st := s.load()
+	var prev [maxHeight]*skipNode
+	if n := st.seek(key, prev[:]); n != nil && n.key == key {
+		//该key已存在,直接替换即可
+		old := n.loadValue()
+		diff := s.sizer.Size(value) - s.sizer.Size(old.Value)
+		if s.cap < st.len+diff {
+			return false
+		}
+		atomic.AddInt64(&st.len, diff)
+		n.storeValue(kv.NewValue(key, value, deleted))
+		return true
+	}
+	add := int64(len(key)) + s.sizer.Size(value) + skipEntryOverhead
+	if s.cap < st.len+add {
+		return false
+	}
+	atomic.AddInt64(&st.len, add)
+	h := s.randomHeight()
+	if height := int(st.height); h > height {
+		for level := height; level < h; level++ {
+			prev[level] = st.head
+		}
+		atomic.StoreInt32(&st.height, int32(h))
+	}
+	n := newSkipNode(key, kv.NewValue(key, value, deleted), h)
+	for level := 0; level < h; level++ {
+		n.next[level] = prev[level].next[level]
+		prev[level].storeNext(level, n)
+	}
+	return true
+}
+
+func (s *skipList) Put(values []*kv.Value) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	for _, v := range values {
+		s.insert(v.Key, v.Value, v.Deleted)
+	}
+}
+
+func (s *skipList) Get(key string) (value any, ok bool) {
+	if v, ok := s.Find(key); ok {
+		return v.Value, true
+	}
+	return nil, false
+}
+
+// Find 查找key对应的记录,包含已被标记删除的记录
+func (s *skipList) Find(key string) (value *kv.Value, ok bool) {
+	if s == nil {
+		return nil, false
+	}
+	if n := s.load().seek(key, nil); n != nil && n.key == key {
+		v := *n.loadValue()
+		return &v, true
+	}
+	return nil, false
+}
+
+// EraseRange 将 [start, end) 内已存在的key全部标记为删除,返回标记的数量
+func (s *skipList) EraseRange(start, end string) int {
+	if s == nil {
+		return 0
+	}
+	s.Lock()
+	defer s.Unlock()
+	st := s.load()
+	count := 0
+	for n := st.seek(start, nil); n != nil && n.key < end; n = n.loadNext(0) {
+		old := n.loadValue()
+		if old.Deleted {
+			continue
+		}
+		atomic.AddInt64(&st.len, -s.sizer.Size(old.Value))
+		n.storeValue(kv.NewValue(n.key, nil, true))
+		count++
+	}
+	return count
+}
+
+// Scan 按 key 升序获取 [start, end) 内所有记录的副本,包含已被标记删除的记录,end 为空时表示不设上限
+func (s *skipList) Scan(start, end string) []*kv.Value {
+	if s == nil {
+		return nil
+	}
+	values := make([]*kv.Value, 0)
+	for it := s.Iterator(start, end); it.Valid(); it.Next() {
+		v := *it.Value()
+		values = append(values, &v)
+	}
+	return values
+}
+
+// ClearAndGainSorted 将跳表替换为空表并按序返回原有的全部记录,只需遍历一遍最底层
+func (s *skipList) ClearAndGainSorted() []*kv.Value {
+	if s == nil {
+		return nil
+	}
+	s.Lock()
+	defer s.Unlock()
+	st := s.load()
+	atomic.StorePointer(&s.state, unsafe.Pointer(newSkipState()))
+	values := make([]*kv.Value, 0)
+	for n := st.head.loadNext(0); n != nil; n = n.loadNext(0) {
+		values = append(values, n.loadValue())
+	}
+	return values
+}
+
+// Iterator 跳表迭代器,按 key 升序遍历,遍历期间的并发写入可能被看到也可能不被看到
+type Iterator struct {
+	node *skipNode
+	end  string
+}
+
+// Iterator 获取遍历 [start, end) 的迭代器,end 为空时表示不设上限
+func (s *skipList) Iterator(start, end string) *Iterator {
+	it := &Iterator{end: end}
+	if s != nil {
+		it.node = s.load().seek(start, nil)
+	}
+	return it
+}
+
+// Valid 迭代器是否仍指向有效的记录
+func (it *Iterator) Valid() bool {
+	return it.node != nil && (it.end == "" || it.node.key < it.end)
+}
+
+// Next 移动到下一条记录
+func (it *Iterator) Next() {
+	it.node = it.node.loadNext(0)
+}
+
+// Key 当前记录的key
+func (it *Iterator) Key() string {
+	return it.node.key
+}
+
+// Value 当前记录,包含已被标记删除的记录,调用方不应修改
+func (it *Iterator) Value() *kv.Value {
+	return it.node.loadValue()
+}
@@ -0,0 +1,362 @@
+package cache
+
+import (
+	"container/list"
+	"github.com/hlccd/hlsm/kv"
+	"sort"
+	"sync"
+)
+
+// Admission 决定窗口中被淘汰的记录能否挤掉主缓存中的记录
+type Admission string
+
+const (
+	FrequencyAdmission Admission = "frequency" // 仅当候选记录的估算访问频率高于被挤掉的记录时才接纳,可抵御扫描
+	AlwaysAdmission    Admission = "always"    // 总是接纳,退化为窗口加分段 LRU
+)
+
+// 允许时接纳候选记录
+func (a Admission) admit(candidate, victim uint8) bool {
+	if a == AlwaysAdmission {
+		return true
+	}
+	return candidate > victim
+}
+
+const (
+	tinyWindowRatio    = 0.01 // 窗口占总容量的比例
+	tinyProtectedRatio = 0.8  // 主缓存中受保护段所占的比例
+	tinyAvgEntrySize   = 64   // 用于估算 sketch 宽度的平均记录大小
+)
+
+// 记录所在的段
+const (
+	windowSegment    = iota // 新记录先进入窗口
+	probationSegment        // 主缓存的试用段,只被访问过一次
+	protectedSegment        // 主缓存的受保护段,在试用段中再次被访问后进入
+)
+
+type tinyEntry struct {
+	value   *kv.Value
+	size    int64
+	segment int
+}
+
+// tinyLFU 即 W-TinyLFU,新记录先进入小的 LRU 窗口,从窗口淘汰后须经过频率准入才能进入分段 LRU 的主缓存,
+// 大量只访问一次的冷 key 只会在窗口中流转,不会挤掉主缓存中的热点 key
+type tinyLFU struct {
+	len, cap     int64                    // 当前容量及容量上限
+	windowLen    int64                    // 窗口当前容量
+	windowCap    int64                    // 窗口容量上限
+	probationLen int64                    // 试用段当前容量
+	protectedLen int64                    // 受保护段当前容量
+	protectedCap int64                    // 受保护段容量上限
+	window       *list.List               // 窗口,越靠近首部越近被访问
+	probation    *list.List               // 试用段
+	protected    *list.List               // 受保护段
+	cache        map[string]*list.Element // 链表元素与key的映射表
+	sketch       *countMinSketch          // 访问频率估算
+	admission    Admission                // 准入策略
+	sizer        Sizer                    // value 大小的估算方式
+	onEvict      OnEvict                  // 淘汰回调
+	stats        Stats                    // 命中统计
+	sync.Mutex                            // 并发控制锁
+}
+
+func NewTinyLFU(cap int64, onEvict OnEvict) *tinyLFU {
+	return NewTinyLFUWithSizer(cap, DeepSizer{}, FrequencyAdmission, onEvict)
+}
+
+// NewTinyLFUWithSizer 以指定的 value 大小估算方式及准入策略创建
+func NewTinyLFUWithSizer(cap int64, sizer Sizer, admission Admission, onEvict OnEvict) *tinyLFU {
+	windowCap := int64(float64(cap) * tinyWindowRatio)
+	if windowCap < lruEntryOverhead*2 {
+		windowCap = lruEntryOverhead * 2
+	}
+	if windowCap > cap {
+		windowCap = cap
+	}
+	return &tinyLFU{
+		cap:          cap,
+		windowCap:    windowCap,
+		protectedCap: int64(float64(cap-windowCap) * tinyProtectedRatio),
+		window:       list.New(),
+		probation:    list.New(),
+		protected:    list.New(),
+		cache:        make(map[string]*list.Element),
+		sketch:       newCountMinSketch(int(cap / tinyAvgEntrySize)),
+		admission:    admission,
+		sizer:        sizer,
+		onEvict:      onEvict,
+	}
+}
+
+// Size 当前估算的占用字节数
+func (t *tinyLFU) Size() int64 {
+	if t == nil {
+		return 0
+	}
+	t.Lock()
+	defer t.Unlock()
+	return t.len
+}
+
+// Cap 配置的容量上限
+func (t *tinyLFU) Cap() int64 {
+	if t == nil {
+		return 0
+	}
+	return t.cap
+}
+
+// Stats 命中统计
+func (t *tinyLFU) Stats() Stats {
+	if t == nil {
+		return Stats{}
+	}
+	t.Lock()
+	defer t.Unlock()
+	return t.stats
+}
+
+// Insert 插入或替换记录,新记录先进入窗口,单条记录超过容量上限时插入失败
+func (t *tinyLFU) Insert(key string, value any) bool {
+	if t == nil {
+		return false
+	}
+	t.Lock()
+	ok, evicted := t.insert(key, value)
+	t.Unlock()
+	t.evicted(evicted)
+	return ok
+}
+
+// Erase 读缓存中没有删除标记,直接移除该记录
+func (t *tinyLFU) Erase(key string) bool {
+	if t == nil {
+		return false
+	}
+	t.Lock()
+	defer t.Unlock()
+	if ele, ok := t.cache[key]; ok {
+		t.remove(ele)
+	}
+	return true
+}
+
+// Put 插入一组记录,删除标记对应的记录直接移除
+func (t *tinyLFU) Put(values []*kv.Value) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	evicted := make([]*kv.Value, 0)
+	for _, v := range values {
+		if v.Deleted {
+			if ele, ok := t.cache[v.Key]; ok {
+				t.remove(ele)
+			}
+			continue
+		}
+		_, e := t.insert(v.Key, v.Value)
+		evicted = append(evicted, e...)
+	}
+	t.Unlock()
+	t.evicted(evicted)
+}
+
+func (t *tinyLFU) Get(key string) (value any, ok bool) {
+	if v, ok := t.Find(key); ok {
+		return v.Value, true
+	}
+	return nil, false
+}
+
+// Find 查找记录,无论是否命中都计入访问频率
+func (t *tinyLFU) Find(key string) (value *kv.Value, ok bool) {
+	if t == nil {
+		return nil, false
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.sketch.increment(key)
+	ele, ok := t.cache[key]
+	if !ok {
+		t.stats.Misses++
+		return nil, false
+	}
+	t.stats.Hits++
+	t.touch(ele)
+	v := *ele.Value.(*tinyEntry).value
+	return &v, true
+}
+
+// EraseRange 移除 [start, end) 内的所有记录,返回移除的数量
+func (t *tinyLFU) EraseRange(start, end string) int {
+	if t == nil {
+		return 0
+	}
+	t.Lock()
+	defer t.Unlock()
+	count := 0
+	for k, ele := range t.cache {
+		if k >= start && k < end {
+			t.remove(ele)
+			count++
+		}
+	}
+	return count
+}
+
+// Scan 按 key 升序获取 [start, end) 内所有记录的副本,end 为空时表示不设上限
+func (t *tinyLFU) Scan(start, end string) []*kv.Value {
+	if t == nil {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	values := make([]*kv.Value, 0)
+	for k, ele := range t.cache {
+		if k < start || (end != "" && k >= end) {
+			continue
+		}
+		v := *ele.Value.(*tinyEntry).value
+		values = append(values, &v)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].Key < values[j].Key
+	})
+	return values
+}
+
+// ClearAndGainSorted 清空读缓存并按序返回原有的全部记录,访问频率不清空
+func (t *tinyLFU) ClearAndGainSorted() []*kv.Value {
+	if t == nil {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	values := make([]*kv.Value, 0, len(t.cache))
+	for _, ele := range t.cache {
+		values = append(values, ele.Value.(*tinyEntry).value)
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return values[i].Key < values[j].Key
+	})
+	t.window.Init()
+	t.probation.Init()
+	t.protected.Init()
+	t.cache = make(map[string]*list.Element)
+	t.len, t.windowLen, t.probationLen, t.protectedLen = 0, 0, 0, 0
+	return values
+}
+
+// 命中后调整记录位置,试用段中的记录晋升到受保护段,调用方需持有锁
+func (t *tinyLFU) touch(ele *list.Element) {
+	e := ele.Value.(*tinyEntry)
+	switch e.segment {
+	case windowSegment:
+		t.window.MoveToFront(ele)
+	case protectedSegment:
+		t.protected.MoveToFront(ele)
+	case probationSegment:
+		t.probation.Remove(ele)
+		t.probationLen -= e.size
+		e.segment = protectedSegment
+		t.cache[e.value.Key] = t.protected.PushFront(e)
+		t.protectedLen += e.size
+		// 受保护段超出容量时将最久未访问的记录降回试用段
+		for t.protectedLen > t.protectedCap && t.protected.Len() > 1 {
+			back := t.protected.Back()
+			d := back.Value.(*tinyEntry)
+			t.protected.Remove(back)
+			t.protectedLen -= d.size
+			d.segment = probationSegment
+			t.cache[d.value.Key] = t.probation.PushFront(d)
+			t.probationLen += d.size
+		}
+	}
+}
+
+// 插入记录并淘汰超出容量的记录,返回被淘汰的记录,调用方需持有锁
+func (t *tinyLFU) insert(key string, value any) (bool, []*kv.Value) {
+	size := int64(len(key)) + t.sizer.Size(value) + lruEntryOverhead
+	if ele, ok := t.cache[key]; ok {
+		// 旧记录已失效,先移除再按新记录插入
+		t.remove(ele)
+	}
+	if size > t.cap {
+		return false, nil
+	}
+	e := &tinyEntry{value: kv.NewValue(key, value, false), size: size, segment: windowSegment}
+	t.cache[key] = t.window.PushFront(e)
+	t.windowLen += size
+	t.len += size
+	evicted := make([]*kv.Value, 0)
+	// 窗口超出容量时,将最久未访问的记录作为候选交给主缓存
+	for t.windowLen > t.windowCap && t.window.Len() > 0 {
+		back := t.window.Back()
+		c := back.Value.(*tinyEntry)
+		t.window.Remove(back)
+		t.windowLen -= c.size
+		c.segment = probationSegment
+		t.cache[c.value.Key] = t.probation.PushFront(c)
+		t.probationLen += c.size
+		evicted = append(evicted, t.admit(c)...)
+	}
+	return true, evicted
+}
+
+// 候选记录已放入试用段首部,容量不足时在候选与主缓存末尾的记录间按准入策略淘汰,调用方需持有锁
+func (t *tinyLFU) admit(c *tinyEntry) []*kv.Value {
+	evicted := make([]*kv.Value, 0)
+	for t.len > t.cap {
+		victim := t.probation.Back()
+		if victim.Value.(*tinyEntry) == c {
+			// 试用段中只剩候选,与受保护段末尾比较
+			if victim = t.protected.Back(); victim == nil {
+				victim = t.cache[c.value.Key]
+			}
+		}
+		v := victim.Value.(*tinyEntry)
+		if v != c && !t.admission.admit(t.sketch.estimate(c.value.Key), t.sketch.estimate(v.value.Key)) {
+			victim = t.cache[c.value.Key]
+			v = c
+		}
+		evicted = append(evicted, v.value)
+		t.remove(victim)
+		t.stats.Evictions++
+		if v == c {
+			break
+		}
+	}
+	return evicted
+}
+
+// 移除链表元素,调用方需持有锁
+func (t *tinyLFU) remove(ele *list.Element) {
+	e := ele.Value.(*tinyEntry)
+	switch e.segment {
+	case windowSegment:
+		t.window.Remove(ele)
+		t.windowLen -= e.size
+	case probationSegment:
+		t.probation.Remove(ele)
+		t.probationLen -= e.size
+	case protectedSegment:
+		t.protected.Remove(ele)
+		t.protectedLen -= e.size
+	}
+	delete(t.cache, e.value.Key)
+	t.len -= e.size
+}
+
+// 在锁外调用淘汰回调
+func (t *tinyLFU) evicted(values []*kv.Value) {
+	if t.onEvict == nil {
+		return
+	}
+	for _, v := range values {
+		t.onEvict(v.Key, v.Value)
+	}
+}
@@ -1,55 +1,311 @@
 package hlsm
 
 import (
+	"context"
 	"errors"
+	"github.com/hlccd/hlsm/kv"
 	"log"
+	"sort"
+	"sync/atomic"
 )
 
+var (
+	errNotFound      = errors.New("未能找到")
+	errFamilyDropped = errors.New("列族已被删除")
+	errCacheFull     = errors.New("写入缓存失败")
+)
+
+// Insert 向默认列族插入数据
 func (lsm *HLsm) Insert(key string, value any) bool {
+	return lsm.defaultFamily().Insert(key, value)
+}
+
+// InsertCtx 向默认列族插入数据,可通过 ctx 中止插入所引发的区块压缩
+func (lsm *HLsm) InsertCtx(ctx context.Context, key string, value any) error {
+	return lsm.defaultFamily().InsertCtx(ctx, key, value)
+}
+
+// Erase 删除默认列族中的数据
+func (lsm *HLsm) Erase(key string) bool {
+	return lsm.defaultFamily().Erase(key)
+}
+
+// DeleteRange 删除默认列族中 [start, end) 内的所有数据
+func (lsm *HLsm) DeleteRange(start, end string) bool {
+	return lsm.defaultFamily().DeleteRange(start, end)
+}
+
+// Get 从默认列族中查找数据
+func (lsm *HLsm) Get(key string) (any, bool) {
+	return lsm.defaultFamily().Get(key)
+}
+
+// GetCtx 从默认列族中查找数据,ctx 结束时放弃查找
+func (lsm *HLsm) GetCtx(ctx context.Context, key string) (any, bool, error) {
+	return lsm.defaultFamily().GetCtx(ctx, key)
+}
+
+// MultiGet 从默认列族中批量查找数据
+func (lsm *HLsm) MultiGet(keys []string) ([]any, []bool) {
+	return lsm.defaultFamily().MultiGet(keys)
+}
+
+// Scan 获取默认列族中 [start, end) 内的数据
+func (lsm *HLsm) Scan(start, end string) []*kv.Value {
+	return lsm.defaultFamily().Scan(start, end)
+}
+
+// ScanCtx 获取默认列族中 [start, end) 内的数据,ctx 结束时放弃扫描
+func (lsm *HLsm) ScanCtx(ctx context.Context, start, end string) ([]*kv.Value, error) {
+	return lsm.defaultFamily().ScanCtx(ctx, start, end)
+}
+
+// Compact 将所有列族的缓存落盘并进行区块压缩
+func (lsm *HLsm) Compact() {
+	_ = lsm.CompactCtx(context.Background())
+}
+
+// CompactCtx 将所有列族的缓存落盘并进行区块压缩,ctx 结束时中止尚未完成的压缩
+func (lsm *HLsm) CompactCtx(ctx context.Context) error {
 	lsm.Lock()
 	defer lsm.Unlock()
-	lsm.Log(key, value, false)
-	if lsm.cache.Insert(key, value) {
-		return true
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	// 区块压缩
-	lsm.compaction()
-	return lsm.cache.Insert(key, value)
+	lsm.flush()
+	return lsm.compact(ctx)
 }
-func (lsm *HLsm) Erase(key string) bool {
+
+func (lsm *HLsm) defaultFamily() *Family {
+	return lsm.def
+}
+
+// 列族是否仍属于数据库,调用方需持有数据库锁
+func (f *Family) alive() bool {
+	return f.lsm.families[f.name] == f
+}
+
+func (f *Family) Insert(key string, value any) bool {
+	return f.InsertCtx(context.Background(), key, value) == nil
+}
+
+// InsertCtx 插入数据,写入生效后返回 nil,
+// 插入引发的区块压缩会在 ctx 结束时中止,但不影响本次写入
+func (f *Family) InsertCtx(ctx context.Context, key string, value any) error {
+	return f.write(ctx, kv.NewValue(key, value, false))
+}
+
+func (f *Family) Erase(key string) bool {
+	return f.write(context.Background(), kv.NewValue(key, nil, true)) == nil
+}
+
+// DeleteRange 删除 [start, end) 内的所有数据,只写入一条范围删除标记
+func (f *Family) DeleteRange(start, end string) bool {
+	if start >= end {
+		return false
+	}
+	v := kv.NewValue(start, nil, true)
+	v.End = end
+	return f.write(context.Background(), v) == nil
+}
+
+// 写入预写日志和缓存,缓存已满时将缓存落盘后重新写入,再检查是否需要压缩
+func (f *Family) write(ctx context.Context, v *kv.Value) error {
+	lsm := f.lsm
+	lsm.stall()
 	lsm.Lock()
 	defer lsm.Unlock()
-	lsm.Log(key, nil, true)
-	if lsm.cache.Erase(key) {
-		return true
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !f.alive() {
+		return errFamilyDropped
+	}
+	v.Family = f.walName()
+	lsm.log(v)
+	if f.apply(v) {
+		return nil
+	}
+	lsm.flush(v)
+	if !f.apply(v) {
+		return errCacheFull
 	}
 	// 区块压缩
-	lsm.compaction()
-	return lsm.cache.Erase(key)
+	lsm.afterFlush(ctx)
+	return nil
 }
-func (lsm *HLsm) Get(key string) (any, bool) {
-	if val, ok := lsm.cache.Get(key); ok {
+
+func (f *Family) Get(key string) (any, bool) {
+	v, ok, _ := f.GetCtx(context.Background(), key)
+	return v, ok
+}
+
+// GetCtx 查找数据,在查找每个区块前检查 ctx,
+// 同一 key 的并发查找共享同一次查找,只有全部调用方都放弃等待时查找才会中止
+func (f *Family) GetCtx(ctx context.Context, key string) (any, bool, error) {
+	if val, ok := f.cache.Find(key); ok {
 		log.Println("命中缓存")
-		return val, true
+		if val.Deleted {
+			return nil, false, nil
+		}
+		return val.Value, true, nil
 	}
-	v, err := lsm.sf.Do(key, func() (any, error) {
+	if f.rangeDeleted(key) {
+		// 被缓存区中的范围删除标记覆盖
+		return nil, false, nil
+	}
+	if val, ok := f.readFind(key); ok {
+		log.Println("命中读缓存")
+		return val.Value, true, nil
+	}
+	v, err, _ := f.sf.DoCtx(ctx, key, func(ctx context.Context) (any, error) {
+		// 查找开始时的写入计数,共享结果的调用方以此判断结果能否放入读缓存
+		gen := atomic.LoadUint64(&f.writeGen)
 		// 从 level 树中查找
-		if val, ok := lsm.tree.Get(key); ok {
+		if val, ok, err := f.tree.GetCtx(ctx, key); err != nil {
+			return nil, err
+		} else if ok {
 			log.Println("命中 level 树")
-			return val, nil
+			return found(val, gen)
 		}
 
 		// 从为载入内存的顶级区块中查找
-		if val, ok := lsm.tree.GetFromStorage(key); ok {
+		if val, ok, err := f.tree.GetFromStorageCtx(ctx, key); err != nil {
+			return nil, err
+		} else if ok {
 			log.Println("命中顶级区块")
-			return val, nil
+			return found(val, gen)
 		}
-		return nil, errors.New("未能找到")
+		return nil, errNotFound
 	})
+	if err == errNotFound {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	r := v.(lookup)
+	f.fillReadCache(key, r.value, r.gen)
+	return r.value, true, nil
+}
+
+// 区块树的查找结果
+type lookup struct {
+	value any
+	gen   uint64 // 查找开始时的写入计数
+}
+
+// 找到的元素为删除标记时视为未找到
+func found(val *kv.Value, gen uint64) (any, error) {
+	if val.Deleted {
+		return nil, errNotFound
+	}
+	return lookup{value: val.Value, gen: gen}, nil
+}
+
+// Scan 获取 [start, end) 内的数据并按 key 升序排列,end 为空时表示不设上限
+func (f *Family) Scan(start, end string) []*kv.Value {
+	values, _ := f.ScanCtx(context.Background(), start, end)
+	return values
+}
+
+// ScanCtx 与 Scan 相同,在扫描每个区块前检查 ctx
+// 缓存中的记录比区块树中的新,缓存中的范围删除标记则覆盖区块树中的数据
+func (f *Family) ScanCtx(ctx context.Context, start, end string) ([]*kv.Value, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	mem := f.cache.Scan(start, end)
+	f.rangeDelLock.RLock()
+	ranges := make([]kv.RangeTombstone, len(f.rangeDels))
+	copy(ranges, f.rangeDels)
+	f.rangeDelLock.RUnlock()
+	stored, err := f.tree.ScanCtx(ctx, start, end)
 	if err != nil {
-		lsm.Erase(key)
-		return nil, false
+		return nil, err
+	}
+	// 归并两个有序列表
+	values := make([]*kv.Value, 0, len(mem)+len(stored))
+	i, j := 0, 0
+	for i < len(mem) || j < len(stored) {
+		if j == len(stored) || (i < len(mem) && mem[i].Key <= stored[j].Key) {
+			if j < len(stored) && mem[i].Key == stored[j].Key {
+				j++
+			}
+			if !mem[i].Deleted {
+				values = append(values, mem[i])
+			}
+			i++
+			continue
+		}
+		if !kv.Covered(ranges, stored[j].Key) {
+			values = append(values, stored[j])
+		}
+		j++
+	}
+	return values, nil
+}
+
+// CompactCtx 将所有列族的缓存落盘并压缩该列族,ctx 结束时中止尚未完成的压缩
+func (f *Family) CompactCtx(ctx context.Context) error {
+	lsm := f.lsm
+	lsm.Lock()
+	defer lsm.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !f.alive() {
+		return errFamilyDropped
+	}
+	lsm.flush()
+	return f.tree.CompactionCtx(ctx, 0)
+}
+
+// MultiGet 批量查找数据,结果与 keys 一一对应
+// 先从缓存中查找,剩余的 key 排序后交由区块树,每个区块只扫描一次
+func (f *Family) MultiGet(keys []string) ([]any, []bool) {
+	values := make([]any, len(keys))
+	oks := make([]bool, len(keys))
+	// 每个 key 对应的结果下标,key 可能重复出现
+	indexes := make(map[string][]int, len(keys))
+	pending := make([]string, 0, len(keys))
+	for i, key := range keys {
+		if _, ok := indexes[key]; !ok {
+			pending = append(pending, key)
+		}
+		indexes[key] = append(indexes[key], i)
+	}
+	sort.Strings(pending)
+
+	set := func(key string, val *kv.Value) {
+		if val.Deleted {
+			return
+		}
+		for _, i := range indexes[key] {
+			values[i] = val.Value
+			oks[i] = true
+		}
+	}
+	rest := pending[:0]
+	for _, key := range pending {
+		if val, ok := f.cache.Find(key); ok {
+			set(key, val)
+		} else if f.rangeDeleted(key) {
+			continue
+		} else if val, ok := f.readFind(key); ok {
+			set(key, val)
+		} else {
+			rest = append(rest, key)
+		}
+	}
+	if len(rest) > 0 {
+		gen := atomic.LoadUint64(&f.writeGen)
+		for key, val := range f.tree.MultiGet(rest) {
+			set(key, val)
+			if !val.Deleted {
+				f.fillReadCache(key, val.Value, gen)
+			}
+		}
 	}
-	lsm.Insert(key, v)
-	return v, true
+	return values, oks
 }
@@ -0,0 +1,99 @@
+package hlsm
+
+import (
+	"context"
+	"github.com/hlccd/hlsm/ssTable"
+	"sync"
+)
+
+// ErrTopBlocksSkipped 手动压缩的各层已完成,但压缩前已有的顶级区块与范围重叠,
+// 顶级区块只追加不合并,其中范围内被覆盖或删除的元素仍占用空间,数据的读写不受影响
+var ErrTopBlocksSkipped = ssTable.ErrTopBlocksSkipped
+
+// CompactionProgress 手动压缩的进度
+type CompactionProgress struct {
+	Levels int // 需要逐层压缩的总层数
+	Done   int // 已完成的层数
+}
+
+// CompactionTask 在后台执行的手动压缩
+type CompactionTask struct {
+	cancel   context.CancelFunc
+	done     chan struct{}
+	progress CompactionProgress
+	err      error
+	lock     sync.Mutex
+}
+
+// Progress 当前进度
+func (t *CompactionTask) Progress() CompactionProgress {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.progress
+}
+
+// Cancel 取消压缩,正在执行的一次压缩会被放弃,已完成的层不受影响
+func (t *CompactionTask) Cancel() {
+	t.cancel()
+}
+
+// Done 压缩结束后关闭
+func (t *CompactionTask) Done() <-chan struct{} {
+	return t.done
+}
+
+// Wait 等待压缩结束,返回压缩失败或被取消的原因,范围与已有的顶级区块重叠时返回 ErrTopBlocksSkipped
+func (t *CompactionTask) Wait() error {
+	<-t.done
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.err
+}
+
+func (t *CompactionTask) report(done, total int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.progress = CompactionProgress{Levels: total, Done: done}
+}
+
+// CompactRange 在后台将默认列族中与 [start, end) 重叠的区块逐层压缩到最下一层,end 为空时表示不设上限
+func (lsm *HLsm) CompactRange(start, end string) *CompactionTask {
+	return lsm.defaultFamily().CompactRange(start, end)
+}
+
+// CompactRange 在后台将所有列族的缓存落盘,再将该列族中与 [start, end) 重叠的区块逐层压缩到最下一层,
+// 最下一层中重叠的区块合并为新的顶级区块,end 为空时表示不设上限,
+// 已有的顶级区块不参与压缩,与范围重叠时 Wait 返回 ErrTopBlocksSkipped
+func (f *Family) CompactRange(start, end string) *CompactionTask {
+	ctx, cancel := context.WithCancel(context.Background())
+	t := &CompactionTask{
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		err := f.compactRange(ctx, start, end, t.report)
+		cancel()
+		t.lock.Lock()
+		t.err = err
+		t.lock.Unlock()
+		close(t.done)
+	}()
+	return t
+}
+
+func (f *Family) compactRange(ctx context.Context, start, end string, progress func(done, total int)) error {
+	lsm := f.lsm
+	lsm.Lock()
+	if err := ctx.Err(); err != nil {
+		lsm.Unlock()
+		return err
+	}
+	if !f.alive() {
+		lsm.Unlock()
+		return errFamilyDropped
+	}
+	lsm.flush()
+	lsm.Unlock()
+	// 压缩期间不持有数据库锁,读写不受影响
+	return f.tree.CompactRangeCtx(ctx, start, end, progress)
+}
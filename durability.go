@@ -2,13 +2,35 @@ package hlsm
 
 import (
 	"encoding/binary"
+	"encoding/json"
 	"github.com/hlccd/hlsm/kv"
 	"log"
 )
 
+// Log 向预写日志中写入一条默认列族的记录
 func (lsm *HLsm) Log(key string, value any, deleted bool) {
+	lsm.log(kv.NewValue(key, value, deleted))
+}
+
+// 为新记录分配写入序号后写入预写日志,并通知变更订阅
+func (lsm *HLsm) log(values ...*kv.Value) {
+	for _, v := range values {
+		lsm.seq++
+		v.Seq = lsm.seq
+	}
+	lsm.writeLog(values...)
+	lsm.publish(values)
+}
+
+// 向预写日志中写入记录,多条记录时整体编码为一条日志,保证其要么全部生效要么全部丢弃
+func (lsm *HLsm) writeLog(values ...*kv.Value) {
+	var data []byte
+	if len(values) == 1 {
+		data, _ = values[0].Encode()
+	} else {
+		data, _ = json.Marshal(values)
+	}
 	// 长度
-	data, _ := kv.NewValue(key, value, deleted).Encode()
 	err := binary.Write(lsm.cacheFile, binary.LittleEndian, int64(len(data)))
 	if err != nil {
 		log.Println("插入kv数据时候写入长度失败")
@@ -0,0 +1,260 @@
+package hlsm
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/hlccd/hlsm/cache"
+	"github.com/hlccd/hlsm/kv"
+	"github.com/hlccd/hlsm/singleFlight"
+	"github.com/hlccd/hlsm/ssTable"
+	"github.com/hlccd/hlsm/vfs"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	DefaultFamily  = "default"     // 默认列族,数据存放于数据目录根部
+	familyInfoName = "family.hlsm" // 列族目录中记录列族配置的文件
+)
+
+// Family 列族,拥有独立的缓存区和区块树,与同一数据库内的其他列族共享预写日志
+type Family struct {
+	name  string                   // 列族名
+	dir   string                   // 列族的数据目录
+	opts  Options                  // 列族配置
+	cache cache.Cache              // 缓存区
+	read  cache.Cache              // 读缓存,未启用时为 nil
+	tree  *ssTable.TableTree       // 区块树,用于区块合并,缓存超过容量上限后会成为一个新区块
+	sf    *singleFlight.Group[any] // 单次请求
+	lsm   *HLsm                    // 所属数据库
+
+	rangeDels    []kv.RangeTombstone // 缓存区中的范围删除标记,随缓存一同落盘
+	rangeDelLock sync.RWMutex        // 范围删除标记的并发控制锁
+	writeGen     uint64              // 写入计数,读缓存只接受查找期间没有发生写入的结果
+}
+
+func newFamily(lsm *HLsm, name, dir string, opts Options) *Family {
+	f := &Family{
+		name:  name,
+		dir:   dir,
+		opts:  opts,
+		cache: opts.newMemtable(),
+		read:  opts.newReadCache(),
+		tree:  ssTable.NewTableTree(dir, opts.CapMin, opts.CapMax),
+		sf:    singleFlight.NewGroup[any](),
+		lsm:   lsm,
+	}
+	f.tree.SetFS(lsm.fs)
+	f.tree.SetBlockCache(lsm.blocks)
+	f.tree.SetMmap(opts.MmapReads)
+	f.tree.SetCompactionPolicy(opts.newCompactionPolicy())
+	f.tree.SetCompactionFilter(opts.CompactionFilter)
+	f.tree.SetRateLimiter(lsm.limiter)
+	f.tree.SetSubcompactions(opts.Subcompactions)
+	return f
+}
+
+// SetCompactionFilter 设置该列族的压缩过滤器,为 nil 时不过滤,之后的压缩生效
+func (f *Family) SetCompactionFilter(filter ssTable.CompactionFilter) {
+	f.tree.SetCompactionFilter(filter)
+}
+
+// Name 列族名
+func (f *Family) Name() string {
+	return f.name
+}
+
+// MemtableSize 缓存区当前估算的占用字节数及配置的容量上限
+func (f *Family) MemtableSize() (estimated, capacity int64) {
+	return f.cache.Size(), f.cache.Cap()
+}
+
+// ReadCacheStats 读缓存的命中统计,未启用读缓存时返回 false
+func (f *Family) ReadCacheStats() (cache.Stats, bool) {
+	if r, ok := f.read.(cache.StatsReporter); ok {
+		return r.Stats(), true
+	}
+	return cache.Stats{}, false
+}
+
+// 从读缓存中查找
+func (f *Family) readFind(key string) (*kv.Value, bool) {
+	if f.read == nil {
+		return nil, false
+	}
+	return f.read.Find(key)
+}
+
+// 将区块树中查得的结果放入读缓存,gen 为查找开始时的写入计数,
+// 写入先递增计数再使读缓存失效,放入后计数已变化时可能与写入交错,需移除可能过期的结果
+func (f *Family) fillReadCache(key string, value any, gen uint64) {
+	if f.read == nil || atomic.LoadUint64(&f.writeGen) != gen {
+		return
+	}
+	f.read.Insert(key, value)
+	if atomic.LoadUint64(&f.writeGen) != gen {
+		f.read.Erase(key)
+	}
+}
+
+// 预写日志中记录的列族名,默认列族记为空以兼容旧日志
+func (f *Family) walName() string {
+	if f.name == DefaultFamily {
+		return ""
+	}
+	return f.name
+}
+
+// 将缓存区内容落盘为第 0 层的新区块
+func (f *Family) flush() {
+	values := f.cache.ClearAndGainSorted()
+	f.rangeDelLock.Lock()
+	ranges := f.rangeDels
+	f.rangeDels = nil
+	f.rangeDelLock.Unlock()
+	if len(values) == 0 && len(ranges) == 0 {
+		return
+	}
+	f.tree.Insert(values, ranges, 0)
+}
+
+// 在缓存区中记录范围删除,缓存中已有的key直接标记为删除,
+// 范围删除标记则用于覆盖已落盘的旧数据
+func (f *Family) deleteRange(start, end string) {
+	f.cache.EraseRange(start, end)
+	f.rangeDelLock.Lock()
+	f.rangeDels = append(f.rangeDels, kv.NewRangeTombstone(start, end))
+	f.rangeDelLock.Unlock()
+}
+
+// 判断 key 是否被缓存区中的范围删除标记覆盖
+func (f *Family) rangeDeleted(key string) bool {
+	f.rangeDelLock.RLock()
+	defer f.rangeDelLock.RUnlock()
+	return kv.Covered(f.rangeDels, key)
+}
+
+func (f *Family) loadSSTable() {
+	infos, err := f.lsm.fs.ReadDir(f.dir)
+	if err != nil {
+		log.Println("读取数据库文件失败")
+		panic(err)
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			// 其他列族的目录
+			continue
+		}
+		// 如果是 SSTable 文件
+		f.tree.LoadDB(info.Name())
+	}
+}
+
+// 从数据目录中加载除默认列族外的所有列族
+func (lsm *HLsm) loadFamilies() {
+	infos, err := lsm.fs.ReadDir(lsm.dir)
+	if err != nil {
+		log.Println("读取数据库文件失败")
+		panic(err)
+	}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		dir := path.Join(lsm.dir, info.Name())
+		data, err := vfs.ReadFile(lsm.fs, path.Join(dir, familyInfoName))
+		if err != nil {
+			// 不是列族目录
+			continue
+		}
+		var opts Options
+		if err = json.Unmarshal(data, &opts); err != nil {
+			log.Println("读取列族配置失败:", info.Name())
+			panic(err)
+		}
+		lsm.families[info.Name()] = newFamily(lsm, info.Name(), dir, opts.withDefaults())
+	}
+}
+
+// Family 获取指定名称的列族
+func (lsm *HLsm) Family(name string) (*Family, bool) {
+	lsm.RLock()
+	defer lsm.RUnlock()
+	f, ok := lsm.families[name]
+	return f, ok
+}
+
+// CreateFamily 创建一个使用独立配置的列族
+func (lsm *HLsm) CreateFamily(name string, opts Options) (*Family, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return nil, errors.New("列族名不合法")
+	}
+	lsm.Lock()
+	defer lsm.Unlock()
+	if _, ok := lsm.families[name]; ok {
+		return nil, errors.New("列族已存在")
+	}
+	opts = opts.withDefaults()
+	dir := path.Join(lsm.dir, name)
+	if _, err := lsm.fs.Stat(dir); err == nil {
+		if _, err = lsm.fs.Stat(path.Join(dir, familyInfoName)); os.IsNotExist(err) {
+			// 删除列族时在删除目录前崩溃留下的数据,已不属于任何列族
+			if err = lsm.fs.RemoveAll(dir); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := lsm.fs.Mkdir(dir, 0777); err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err = vfs.WriteFile(lsm.fs, path.Join(dir, familyInfoName), data); err != nil {
+		_ = lsm.fs.RemoveAll(dir)
+		return nil, err
+	}
+	f := newFamily(lsm, name, dir, opts)
+	lsm.families[name] = f
+	return f, nil
+}
+
+// DropFamily 删除列族及其所有数据,默认列族不可删除
+func (lsm *HLsm) DropFamily(name string) error {
+	if name == DefaultFamily {
+		return errors.New("默认列族不可删除")
+	}
+	lsm.Lock()
+	defer lsm.Unlock()
+	f, ok := lsm.families[name]
+	if !ok {
+		return errors.New("列族不存在")
+	}
+	// 先删除列族配置,之后即使在删除目录前崩溃,重新打开时也不会再载入该列族
+	if err := lsm.fs.Remove(path.Join(f.dir, familyInfoName)); err != nil {
+		return err
+	}
+	delete(lsm.families, name)
+	// 预写日志中仍有该列族的记录,将其余列族落盘后重置日志以清除这些记录
+	lsm.compaction()
+	f.tree.Close()
+	return lsm.fs.RemoveAll(f.dir)
+}
+
+// ListFamilies 获取所有列族名
+func (lsm *HLsm) ListFamilies() []string {
+	lsm.RLock()
+	defer lsm.RUnlock()
+	names := make([]string, 0, len(lsm.families))
+	for name := range lsm.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
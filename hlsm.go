@@ -1,9 +1,15 @@
 package hlsm
 
 import (
+	"context"
+	"errors"
 	"github.com/hlccd/hlsm/cache"
+	"github.com/hlccd/hlsm/kv"
+	"github.com/hlccd/hlsm/rateLimiter"
 	"github.com/hlccd/hlsm/ssTable"
-	"os"
+	"github.com/hlccd/hlsm/vfs"
+	"io"
+	"log"
 	"path"
 	"sync"
 )
@@ -16,52 +22,190 @@ const (
 )
 
 type HLsm struct {
-	dir       string             // 数据目录
-	capMin    int64              // 最小区块容量,也可以当作缓存容量
-	capMax    int64              // 最大区块容量,超过后进行持久化存储,不再进行合并
-	cacheFile *os.File           // 缓冲区的文件句柄
-	cache     cache.Cache        // 缓存区
-	tree      *ssTable.TableTree // 区块树,用于区块合并,缓存超过容量上限后会成为一个新区块
-	sf        *singleFlight      // 单次请求
+	dir       string               // 数据目录
+	opts      Options              // 数据库配置,同时作为默认列族的配置
+	cacheFile vfs.File             // 缓冲区的文件句柄,即所有列族共享的预写日志
+	families  map[string]*Family   // 列族名与列族的映射表
+	def       *Family              // 默认列族,不可删除,读写时无需经过数据库锁查找
+	blocks    *cache.BlockCache    // 所有列族共享的块缓存,未启用时为 nil
+	limiter   *rateLimiter.Limiter // 所有列族共享的落盘及压缩限速器
+	bg        compactor            // 后台压缩的状态
+	fs        vfs.FS               // 数据目录所在的文件系统
+	dirLock   io.Closer            // 数据目录的锁,关闭后为 nil
 	//dur *durability.Durability
+	seq      uint64          // 最近一次分配的写入序号
+	subs     []*Subscription // 变更订阅
+	subsLock sync.Mutex      // 变更订阅的并发控制锁
 	sync.RWMutex
 }
 
 func NewHLsm(dir string, capMin, capMax int64) *HLsm {
+	return NewHLsmWithOptions(dir, Options{
+		CapMin: capMin,
+		CapMax: capMax,
+	})
+}
+
+// NewHLsmWithOptions 以给定配置创建数据库
+func NewHLsmWithOptions(dir string, opts Options) *HLsm {
 	if dir == "" {
 		dir = "."
 	}
+	if opts.InMemory && opts.FS == nil {
+		opts.FS = vfs.NewMem()
+	}
+	opts = opts.withDefaults()
+	if opts.InMemory {
+		// 内存中的文件无法映射
+		opts.MmapReads = false
+		if err := opts.FS.MkdirAll(dir, 0777); err != nil {
+			log.Println("创建数据目录失败:", dir)
+			panic(err)
+		}
+	}
 	lsm := &HLsm{
-		dir:    dir,
-		capMin: capMin,
-		capMax: capMax,
-		cache:  cache.NewLRU(capMin),
-		tree:   ssTable.NewTableTree(dir, capMin, capMax),
-		sf:     newSingleFlight(),
-	}
-	// 从磁盘中加载缓存内容和非顶级区块的key
-	lsm.cacheFile = lsm.loadCache()
-	lsm.loadSSTable()
+		dir:      dir,
+		opts:     opts,
+		families: make(map[string]*Family),
+		fs:       opts.FS,
+	}
+	dirLock, err := lsm.fs.Lock(path.Join(dir, lockName))
+	if err != nil {
+		log.Println("数据目录已被打开:", dir)
+		panic(err)
+	}
+	lsm.dirLock = dirLock
+	if opts.BlockCacheSize > 0 {
+		lsm.blocks = cache.NewBlockCache(opts.BlockCacheSize)
+	}
+	lsm.limiter = rateLimiter.New(opts.RateLimit, opts.RateLimitBurst)
+	lsm.bg.cond = sync.NewCond(&lsm.bg.lock)
+	lsm.def = newFamily(lsm, DefaultFamily, dir, opts)
+	lsm.families[DefaultFamily] = lsm.def
+	// 从磁盘中加载列族、非顶级区块的key和缓存内容,回放日志时可能落盘,需先载入已有的区块
+	lsm.loadFamilies()
+	for _, f := range lsm.families {
+		f.loadSSTable()
+	}
+	if lsm.loadCache() {
+		lsm.afterFlush(context.Background())
+	}
 	return lsm
 }
-func (lsm *HLsm) compaction() {
-	lsm.tree.Insert(lsm.cache.ClearAndGainSorted(), 0)
-	lsm.tree.Compaction(0)
-	lsm.cacheFileReset()
+
+// Close 等待后台压缩结束,关闭预写日志及所有区块文件并释放数据目录的锁,之后不可再使用该数据库,
+// 缓存区中的数据已记录在预写日志中,重新打开后恢复
+func (lsm *HLsm) Close() error {
+	lsm.waitCompaction()
+	lsm.Lock()
+	defer lsm.Unlock()
+	if lsm.dirLock == nil {
+		return errors.New("数据库已关闭")
+	}
+	for _, f := range lsm.families {
+		f.tree.Close()
+	}
+	err := lsm.cacheFile.Close()
+	if lockErr := lsm.dirLock.Close(); err == nil {
+		err = lockErr
+	}
+	lsm.dirLock = nil
+	return err
+}
+
+// BlockCacheStats 块缓存各层的命中统计,key 为层级,顶级区块记为各列族的最大层数,未启用块缓存时为空
+func (lsm *HLsm) BlockCacheStats() map[int]cache.Stats {
+	return lsm.blocks.Stats()
 }
-func (lsm *HLsm) cacheFileReset() {
+
+// WriteStats 所有列族写入硬盘的字节数之和
+func (lsm *HLsm) WriteStats() ssTable.WriteStats {
+	var stats ssTable.WriteStats
+	lsm.RLock()
+	defer lsm.RUnlock()
+	for _, f := range lsm.families {
+		s := f.tree.WriteStats()
+		stats.Flushed += s.Flushed
+		stats.Compacted += s.Compacted
+	}
+	return stats
+}
+
+// CompactionStats 所有列族的压缩统计之和
+func (lsm *HLsm) CompactionStats() ssTable.CompactionStats {
+	var stats ssTable.CompactionStats
+	lsm.RLock()
+	defer lsm.RUnlock()
+	for _, f := range lsm.families {
+		s := f.tree.CompactionStats()
+		stats.Compactions += s.Compactions
+		stats.TombstonesDropped += s.TombstonesDropped
+	}
+	return stats
+}
+
+// compaction 将所有列族的缓存落盘并检查是否需要压缩
+func (lsm *HLsm) compaction(pending ...*kv.Value) {
+	lsm.flush(pending...)
+	lsm.afterFlush(context.Background())
+}
+
+// flush 所有列族共享同一份预写日志,故任一列族缓存满时将所有列族的缓存一并落盘,
+// 随后以 pending 作为新日志的初始内容重置预写日志
+func (lsm *HLsm) flush(pending ...*kv.Value) {
+	for _, f := range lsm.families {
+		f.flush()
+	}
+	lsm.cacheFileReset(pending...)
+}
+
+// compact 检查所有列族是否需要压缩,ctx 结束时中止尚未完成的压缩
+func (lsm *HLsm) compact(ctx context.Context) error {
+	for _, f := range lsm.families {
+		if err := f.tree.CompactionCtx(ctx, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (lsm *HLsm) cacheFileReset(pending ...*kv.Value) {
 	err := lsm.cacheFile.Close()
 	if err != nil {
 		panic(err)
 	}
 	lsm.cacheFile = nil
-	err = os.Remove(path.Join(lsm.dir, cacheName))
+	// 先记录写入序号,重启后即使日志为空也能继续递增
+	lsm.saveSequence()
+	// 先写入临时文件再替换,保证替换前后总有一份完整的日志
+	tmp := path.Join(lsm.dir, cacheName+".tmp")
+	f, err := lsm.fs.Create(tmp)
 	if err != nil {
 		panic(err)
 	}
-	f, err := os.OpenFile(path.Join(lsm.dir, cacheName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	lsm.cacheFile = f
+	if len(pending) > 0 {
+		lsm.writeLog(pending...)
+	}
+	if lsm.opts.WalRetention > 0 {
+		// 保留旧日志用于变更订阅的回放,分段以其最后一条记录的序号命名,没有新记录时无需保留
+		segments := lsm.walSegments()
+		if len(segments) == 0 || walSegmentSeq(segments[len(segments)-1]) < lsm.seq {
+			err = lsm.fs.Rename(path.Join(lsm.dir, cacheName), path.Join(lsm.dir, walSegmentName(lsm.seq)))
+			if err != nil {
+				panic(err)
+			}
+			segments = append(segments, walSegmentName(lsm.seq))
+		}
+		for len(segments) > lsm.opts.WalRetention {
+			if err = lsm.fs.Remove(path.Join(lsm.dir, segments[0])); err != nil {
+				panic(err)
+			}
+			segments = segments[1:]
+		}
+	}
+	err = lsm.fs.Rename(tmp, path.Join(lsm.dir, cacheName))
 	if err != nil {
 		panic(err)
 	}
-	lsm.cacheFile = f
 }
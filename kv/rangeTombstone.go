@@ -0,0 +1,56 @@
+package kv
+
+import "sort"
+
+// RangeTombstone 范围删除标记,表示 [Start, End) 内的 key 均已被删除
+type RangeTombstone struct {
+	Start string
+	End   string
+}
+
+func NewRangeTombstone(start, end string) RangeTombstone {
+	return RangeTombstone{
+		Start: start,
+		End:   end,
+	}
+}
+
+// Contains 判断 key 是否处于删除范围内
+func (r RangeTombstone) Contains(key string) bool {
+	return r.Start <= key && key < r.End
+}
+
+// Covered 判断 key 是否被任一范围删除标记覆盖
+func Covered(ranges []RangeTombstone, key string) bool {
+	for _, r := range ranges {
+		if r.Contains(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// MergeRanges 将范围删除标记排序并合并重叠部分
+func MergeRanges(ranges []RangeTombstone) []RangeTombstone {
+	if len(ranges) == 0 {
+		return nil
+	}
+	sorted := make([]RangeTombstone, len(ranges))
+	copy(sorted, ranges)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+	merged := make([]RangeTombstone, 0, len(sorted))
+	merged = append(merged, sorted[0])
+	for _, r := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if r.Start <= last.End {
+			if r.End > last.End {
+				last.End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
@@ -14,6 +14,9 @@ type Value struct {
 	Key     string
 	Value   any
 	Deleted bool
+	Family  string `json:",omitempty"` // 所属列族,仅在预写日志中使用,为空表示默认列族
+	End     string `json:",omitempty"` // 范围删除的结束 key,仅在预写日志中使用,不为空时表示删除 [Key, End)
+	Seq     uint64 `json:",omitempty"` // 写入序号,仅在预写日志中使用,由数据库递增分配
 }
 
 func NewValue(key string, value any, delete bool) *Value {
@@ -37,10 +40,17 @@ func (v Value) Encode() ([]byte, error) {
 }
 
 func GetValue(data []byte, size int64) []*Value {
+	values, _ := GetValues(data, size)
+	return values
+}
+
+// GetValues 解析日志数据,同时返回完整记录所占的字节数,末尾未写完的记录不计入
+func GetValues(data []byte, size int64) ([]*Value, int64) {
 	values := make([]*Value, 0, 0)
 	dataLen := int64(0) // 元素的字节数量
 	index := int64(0)   // 当前索引
-	for index < size {
+	valid := int64(0)   // 完整记录的字节数
+	for index+indexBits <= size {
 		// 前面的 8 个字节表示元素的长度
 		indexData := data[index:(index + indexBits)]
 		// 获取元素的字节长度
@@ -51,15 +61,30 @@ func GetValue(data []byte, size int64) []*Value {
 		}
 		// 将元素的所有字节读取出来，并还原为 kv.Value
 		index += indexBits
+		if dataLen < 0 || index+dataLen > size {
+			// 末尾的记录未能完整写入,视为未提交,直接丢弃
+			break
+		}
 		dataArea := data[index:(index + dataLen)]
-		var value *Value
-		err = json.Unmarshal(dataArea, &value)
-		if err != nil {
-			panic(err)
+		// 以 '[' 开头的记录为批量写入,整体作为一条记录以保证原子性
+		if len(dataArea) > 0 && dataArea[0] == '[' {
+			var batch []*Value
+			err = json.Unmarshal(dataArea, &batch)
+			if err != nil {
+				panic(err)
+			}
+			values = append(values, batch...)
+		} else {
+			var value *Value
+			err = json.Unmarshal(dataArea, &value)
+			if err != nil {
+				panic(err)
+			}
+			values = append(values, value)
 		}
 		// 读取下一个元素
 		index = index + dataLen
-		values = append(values, value)
+		valid = index
 	}
-	return values
+	return values, valid
 }
@@ -1,26 +1,46 @@
 package hlsm
 
 import (
+	"encoding/binary"
+	"fmt"
 	"github.com/hlccd/hlsm/kv"
-	"io/ioutil"
+	"github.com/hlccd/hlsm/vfs"
 	"log"
 	"os"
 	"path"
+	"sort"
+	"strings"
 )
 
 const (
-	cacheName = "cache.hlsm"
+	cacheName    = "cache.hlsm"
+	sequenceName = "sequence.hlsm" // 记录预写日志重置时的最大写入序号
+	walPre       = "wal"           // 保留的旧预写日志分段文件前缀
+	walSuffix    = "hlsm"
+	lockName     = "lock.hlsm" // 数据目录的锁文件,同一数据目录同时只能被打开一次
 )
 
-func (lsm *HLsm) loadCache() *os.File {
-	file, err := os.OpenFile(path.Join(lsm.dir, cacheName), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+// 打开预写日志并回放其中的记录,回放时缓存已满而落盘则返回 true
+func (lsm *HLsm) loadCache() bool {
+	lsm.loadSequence()
+	if _, err := lsm.fs.Stat(path.Join(lsm.dir, cacheName)); os.IsNotExist(err) {
+		// 重置预写日志时在替换前崩溃,临时文件即为完整的新日志
+		if _, err = lsm.fs.Stat(path.Join(lsm.dir, cacheName+".tmp")); err == nil {
+			if err = lsm.fs.Rename(path.Join(lsm.dir, cacheName+".tmp"), path.Join(lsm.dir, cacheName)); err != nil {
+				log.Println("无法恢复缓冲文件")
+				panic(err)
+			}
+		}
+	}
+	file, err := lsm.fs.Append(path.Join(lsm.dir, cacheName))
 	if err != nil {
 		log.Println("缓存文件创建失败")
 		panic(err)
 	}
-	info, _ := os.Stat(path.Join(lsm.dir, cacheName))
+	lsm.cacheFile = file
+	info, _ := file.Stat()
 	if info.Size() == 0 {
-		return file
+		return false
 	}
 	// 将文件内容全部读取到内存
 	data := make([]byte, info.Size())
@@ -34,17 +54,108 @@ func (lsm *HLsm) loadCache() *os.File {
 		log.Println("无法打开缓冲文件")
 		panic(err)
 	}
-	lsm.cache.Put(kv.GetValue(data, info.Size()))
-	return file
+	all, valid := kv.GetValues(data, info.Size())
+	if valid < info.Size() {
+		// 截掉末尾未写完的记录,避免后续追加的记录无法解析
+		if err = file.Truncate(valid); err != nil {
+			log.Println("无法截断缓冲文件")
+			panic(err)
+		}
+	}
+	for _, v := range all {
+		if v.Seq > lsm.seq {
+			lsm.seq = v.Seq
+		}
+	}
+	// 按日志顺序生效,范围删除需要按日志顺序生效,已删除列族的记录直接忽略
+	flushed, dropped := false, false
+	for i, v := range all {
+		name := v.Family
+		if name == "" {
+			name = DefaultFamily
+		}
+		f, ok := lsm.families[name]
+		if !ok {
+			dropped = true
+			continue
+		}
+		if f.apply(v) {
+			continue
+		}
+		// 日志中的值解码后估算的大小可能大于写入时,缓存已满时与写入时相同,
+		// 落盘后将尚未生效的记录作为新日志的初始内容,不丢弃任何已记录的写入
+		lsm.flush(all[i:]...)
+		flushed = true
+		if !f.apply(v) {
+			// 单条记录超过缓存区容量,直接落盘为一个区块
+			f.tree.Insert([]*kv.Value{kv.NewValue(v.Key, v.Value, v.Deleted)}, nil, 0)
+			lsm.cacheFileReset(all[i+1:]...)
+		}
+	}
+	if dropped {
+		// 删除列族时在重置日志前崩溃,落盘后重置日志以清除其记录,避免之后同名的新列族回放这些记录
+		lsm.flush()
+		flushed = true
+	}
+	return flushed
+}
+
+// 加载预写日志重置时记录的写入序号
+func (lsm *HLsm) loadSequence() {
+	data, err := vfs.ReadFile(lsm.fs, path.Join(lsm.dir, sequenceName))
+	if err != nil || len(data) < 8 {
+		return
+	}
+	lsm.seq = binary.LittleEndian.Uint64(data)
+}
+
+// 保存当前的写入序号,预写日志重置后仍可继续递增
+func (lsm *HLsm) saveSequence() {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, lsm.seq)
+	err := vfs.WriteFile(lsm.fs, path.Join(lsm.dir, sequenceName), data)
+	if err != nil {
+		log.Println("写入序号保存失败")
+		panic(err)
+	}
 }
-func (lsm *HLsm) loadSSTable() {
-	infos, err := ioutil.ReadDir(lsm.dir)
+
+// 读取一份预写日志文件中的所有记录
+func (lsm *HLsm) readLog(p string) []*kv.Value {
+	data, err := vfs.ReadFile(lsm.fs, p)
+	if err != nil {
+		return nil
+	}
+	values, _ := kv.GetValues(data, int64(len(data)))
+	return values
+}
+
+// 保留的旧预写日志分段文件名,以其最后一条记录的序号命名,按文件名排序即为时间顺序
+func walSegmentName(lastSeq uint64) string {
+	return fmt.Sprintf("%s.%020d.%s", walPre, lastSeq, walSuffix)
+}
+
+// 获取所有保留的旧预写日志分段,由旧到新排列
+func (lsm *HLsm) walSegments() []string {
+	infos, err := lsm.fs.ReadDir(lsm.dir)
 	if err != nil {
 		log.Println("读取数据库文件失败")
 		panic(err)
 	}
+	segments := make([]string, 0)
 	for _, info := range infos {
-		// 如果是 SSTable 文件
-		lsm.tree.LoadDB(info.Name())
+		name := info.Name()
+		if strings.HasPrefix(name, walPre+".") && strings.HasSuffix(name, "."+walSuffix) {
+			segments = append(segments, name)
+		}
 	}
+	sort.Strings(segments)
+	return segments
+}
+
+// 获取分段文件最后一条记录的序号
+func walSegmentSeq(name string) uint64 {
+	var seq uint64
+	_, _ = fmt.Sscanf(name, walPre+".%d."+walSuffix, &seq)
+	return seq
 }
@@ -0,0 +1,194 @@
+package hlsm
+
+import (
+	"github.com/hlccd/hlsm/cache"
+	"github.com/hlccd/hlsm/ssTable"
+	"github.com/hlccd/hlsm/vfs"
+)
+
+// MemtableKind 缓存区的实现方式
+type MemtableKind string
+
+const (
+	LRUMemtable      MemtableKind = "lru"      // 链表加映射表,落盘时需排序
+	SkipListMemtable MemtableKind = "skiplist" // 并发跳表,读无锁且始终有序
+)
+
+// SizerKind 缓存记录大小的估算方式
+type SizerKind string
+
+const (
+	DeepSize    SizerKind = "deep"    // 通过反射估算 value 实际占用的内存
+	EncodedSize SizerKind = "encoded" // 以 value 编码后的长度作为其大小
+)
+
+// ReadCacheKind 读缓存的淘汰策略
+type ReadCacheKind string
+
+const (
+	LRUReadCache     ReadCacheKind = "lru"     // 淘汰最久未被访问的记录
+	TinyLFUReadCache ReadCacheKind = "tinylfu" // W-TinyLFU,按访问频率准入,可抵御大范围扫描对热点 key 的冲刷
+)
+
+// CompactionKind 压缩策略
+type CompactionKind string
+
+const (
+	LeveledCompaction CompactionKind = "leveled" // 分层压缩,每层区块互不重叠,读放大与空间放大小
+	TieredCompaction  CompactionKind = "tiered"  // 分级压缩,每层区块攒够后整体合并到下一层,写放大小,适合写入密集的场景
+	FIFOCompaction    CompactionKind = "fifo"    // 先进先出,从不合并,总大小超过 FIFOMaxSize 时删除最旧的区块,适合时序缓存
+)
+
+// Options 数据库及列族的配置项,每个列族都可持有独立的一份
+type Options struct {
+	CapMin int64 // 最小区块容量,也可以当作缓存容量
+	CapMax int64 // 最大区块容量,超过后进行持久化存储,不再进行合并
+
+	Memtable MemtableKind // 缓存区的实现方式,默认为 LRUMemtable
+	Sizer    SizerKind    // 缓存记录大小的估算方式,默认为 DeepSize
+
+	// 缓存区的分片数量,大于 1 时按 key 的哈希分散到多个各自加锁的分片以减少锁竞争,
+	// 每个分片的容量为 CapMin 的 1/n,任一分片写满即落盘
+	MemtableShards int
+
+	ReadCacheSize      int64           // 读缓存容量,为 0 时不启用,读缓存容量不足时会淘汰记录,与缓存区相互独立
+	ReadCachePolicy    ReadCacheKind   // 读缓存的淘汰策略,默认为 LRUReadCache
+	ReadCacheAdmission cache.Admission // TinyLFUReadCache 的准入策略,默认为 cache.FrequencyAdmission
+	ReadCacheShards    int             // 读缓存的分片数量,大于 1 时分片,每个分片独立淘汰
+
+	MmapReads bool // 非顶级区块的数据区是否映射到内存读取,查找时不再需要系统调用,仅 Linux 支持,其他平台仍使用 ReadAt
+
+	BlockCacheSize int64 // 块缓存容量,为 0 时不启用,缓存从区块中读取并解码后的元素,由所有列族共享,仅对数据库生效
+
+	Compaction  CompactionKind // 压缩策略,默认为 LeveledCompaction
+	FIFOMaxSize int64          // FIFOCompaction 下所有区块的总大小上限,默认为 CapMax
+
+	// 单次压缩最多按 key 范围拆分出的子压缩数量,各子压缩由独立的协程并发执行并写入各自的输出区块,
+	// 结果与不拆分时相同,默认为 1 即不拆分
+	Subcompactions int
+
+	// 压缩过滤器,合并区块时对每个元素调用,可删除或改写元素,为 nil 时不过滤,
+	// 不会随列族配置保存,重新打开数据库后需通过 Family.SetCompactionFilter 重新设置
+	CompactionFilter ssTable.CompactionFilter `json:"-"`
+
+	WalRetention int // 预写日志重置后保留的旧日志分段数量,用于变更订阅的回放,仅对数据库生效
+
+	// 落盘及压缩读写硬盘的速率上限,单位为字节每秒,为 0 时不限速,由所有列族共享,仅对数据库生效,
+	// 可通过 HLsm.SetRateLimit 在运行时修改
+	RateLimit      int64
+	RateLimitBurst int64 // 限速时允许的突发字节数,默认为 RateLimit
+
+	// 压缩在后台协程中进行,写入只需等待落盘,仅对数据库生效,
+	// 尚未压缩的落盘次数达到 SlowdownTrigger 时每次写入延迟 1ms,达到 StopTrigger 时写入阻塞直到压缩跟上
+	BackgroundCompaction bool
+	SlowdownTrigger      int // 默认为 8
+	StopTrigger          int // 默认为 16
+
+	// 数据目录所在的文件系统,默认为 vfs.OS() 即直接读写硬盘,可使用 vfs.NewMem() 或 vfs.NewFault 进行测试,仅对数据库生效
+	FS vfs.FS `json:"-"`
+
+	// 纯内存模式,所有文件保存在数据库独有的内存文件系统中,不读写硬盘,落盘、压缩及顶级区块与硬盘模式完全相同,
+	// 数据目录不存在时自动创建,关闭后数据随之丢弃,用于测试,FS 不为 nil 时使用 FS,仅对数据库生效
+	InMemory bool `json:"-"`
+}
+
+// DefaultOptions 默认配置
+func DefaultOptions() Options {
+	return Options{
+		CapMin: 4 * MB,
+		CapMax: 256 * MB,
+	}
+}
+
+// 未设置的配置项使用默认值
+func (opts Options) withDefaults() Options {
+	def := DefaultOptions()
+	if opts.CapMin <= 0 {
+		opts.CapMin = def.CapMin
+	}
+	if opts.CapMax < opts.CapMin {
+		opts.CapMax = opts.CapMin
+	}
+	if opts.Memtable == "" {
+		opts.Memtable = LRUMemtable
+	}
+	if opts.Sizer == "" {
+		opts.Sizer = DeepSize
+	}
+	if opts.ReadCachePolicy == "" {
+		opts.ReadCachePolicy = LRUReadCache
+	}
+	if opts.ReadCacheAdmission == "" {
+		opts.ReadCacheAdmission = cache.FrequencyAdmission
+	}
+	if opts.Compaction == "" {
+		opts.Compaction = LeveledCompaction
+	}
+	if opts.FIFOMaxSize <= 0 {
+		opts.FIFOMaxSize = opts.CapMax
+	}
+	if opts.Subcompactions <= 0 {
+		opts.Subcompactions = 1
+	}
+	if opts.SlowdownTrigger <= 0 {
+		opts.SlowdownTrigger = 8
+	}
+	if opts.StopTrigger < opts.SlowdownTrigger {
+		opts.StopTrigger = opts.SlowdownTrigger * 2
+	}
+	if opts.FS == nil {
+		opts.FS = vfs.OS()
+	}
+	return opts
+}
+
+func (opts Options) newSizer() cache.Sizer {
+	if opts.Sizer == EncodedSize {
+		return cache.EncodedSizer{}
+	}
+	return cache.DeepSizer{}
+}
+
+// 按配置创建缓存区
+func (opts Options) newMemtable() cache.Cache {
+	sizer := opts.newSizer()
+	newShard := func(cap int64) cache.Cache {
+		if opts.Memtable == SkipListMemtable {
+			return cache.NewSkipListWithSizer(cap, sizer)
+		}
+		return cache.NewLRUWithSizer(cap, sizer)
+	}
+	if opts.MemtableShards > 1 {
+		return cache.NewSharded(opts.MemtableShards, opts.CapMin, newShard)
+	}
+	return newShard(opts.CapMin)
+}
+
+// 按配置创建读缓存,未启用时返回 nil
+func (opts Options) newReadCache() cache.Cache {
+	if opts.ReadCacheSize <= 0 {
+		return nil
+	}
+	sizer := opts.newSizer()
+	newShard := func(cap int64) cache.Cache {
+		if opts.ReadCachePolicy == TinyLFUReadCache {
+			return cache.NewTinyLFUWithSizer(cap, sizer, opts.ReadCacheAdmission, nil)
+		}
+		return cache.NewReadLRUWithSizer(cap, sizer, nil)
+	}
+	if opts.ReadCacheShards > 1 {
+		return cache.NewSharded(opts.ReadCacheShards, opts.ReadCacheSize, newShard)
+	}
+	return newShard(opts.ReadCacheSize)
+}
+
+// 按配置创建压缩策略
+func (opts Options) newCompactionPolicy() ssTable.CompactionPolicy {
+	switch opts.Compaction {
+	case TieredCompaction:
+		return ssTable.NewTieredPolicy()
+	case FIFOCompaction:
+		return ssTable.NewFIFOPolicy(opts.FIFOMaxSize)
+	}
+	return ssTable.NewLeveledPolicy()
+}
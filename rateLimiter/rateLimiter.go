@@ -0,0 +1,105 @@
+package rateLimiter
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter 令牌桶限速器,以字节为单位,令牌按 rate 每秒匀速补充,最多积累 burst 个,
+// 单次申请超过剩余令牌时先行透支,调用方等待透支部分补足后再继续,因此单次申请可以大于 burst
+type Limiter struct {
+	rate   int64     // 每秒补充的令牌数,小于等于 0 时不限速
+	burst  int64     // 令牌数上限
+	tokens float64   // 当前令牌数,透支时为负
+	last   time.Time // 上次补充令牌的时间
+	sync.Mutex
+}
+
+// New 创建限速器,rate 小于等于 0 时不限速,burst 小于等于 0 时为 rate
+func New(rate, burst int64) *Limiter {
+	l := &Limiter{last: time.Now()}
+	l.SetRate(rate, burst)
+	return l
+}
+
+// SetRate 修改速率及令牌数上限,已积累的令牌按原速率结算,超出新上限的部分丢弃
+func (l *Limiter) SetRate(rate, burst int64) {
+	if l == nil {
+		return
+	}
+	if burst <= 0 {
+		burst = rate
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.refill(time.Now())
+	if l.rate <= 0 {
+		// 由不限速改为限速时从满桶开始
+		l.tokens = float64(burst)
+	}
+	l.rate, l.burst = rate, burst
+	if l.tokens > float64(burst) {
+		l.tokens = float64(burst)
+	}
+}
+
+// Rate 当前的速率及令牌数上限
+func (l *Limiter) Rate() (rate, burst int64) {
+	if l == nil {
+		return 0, 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	return l.rate, l.burst
+}
+
+// Wait 申请 n 个令牌,不足时阻塞等待
+func (l *Limiter) Wait(n int64) {
+	_ = l.WaitCtx(context.Background(), n)
+}
+
+// WaitCtx 与 Wait 相同,ctx 结束时停止等待并返回其错误,已申请的令牌不退还
+func (l *Limiter) WaitCtx(ctx context.Context, n int64) error {
+	delay := l.reserve(n)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// 扣除 n 个令牌,返回需要等待的时间
+func (l *Limiter) reserve(n int64) time.Duration {
+	if l == nil || n <= 0 {
+		return 0
+	}
+	l.Lock()
+	defer l.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+}
+
+// 按经过的时间补充令牌,调用方需持有锁
+func (l *Limiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > float64(l.burst) {
+			l.tokens = float64(l.burst)
+		}
+	}
+	l.last = now
+}
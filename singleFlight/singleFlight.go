@@ -0,0 +1,216 @@
+package singleFlight
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// ErrGoexit 请求函数调用了 runtime.Goexit 而未能返回
+var ErrGoexit = errors.New("请求函数调用了 runtime.Goexit")
+
+// PanicError 请求函数发生的 panic,会传递给等待该请求的所有调用方
+type PanicError struct {
+	Value any    // panic 的值
+	Stack []byte // 发生 panic 时的调用栈
+}
+
+func (p *PanicError) Error() string {
+	return fmt.Sprintf("%v\n\n%s", p.Value, p.Stack)
+}
+
+func newPanicError(v any) error {
+	stack := debug.Stack()
+	// 去掉第一行的 goroutine 编号,它与调用方的 goroutine 无关
+	if line := bytes.IndexByte(stack, '\n'); line >= 0 {
+		stack = stack[line+1:]
+	}
+	return &PanicError{Value: v, Stack: stack}
+}
+
+// Result 请求结果,Shared 表示该结果是否被多个调用方共享
+type Result[T any] struct {
+	Val    T
+	Err    error
+	Shared bool
+}
+
+// 呼叫请求结构体
+type call[T any] struct {
+	sync.WaitGroup                    //可重入锁
+	val            T                  //请求结果
+	err            error              //错误反馈
+	dups           int                //除发起者外加入该请求的调用方数量
+	chans          []chan<- Result[T] //通过 DoChan 等待结果的调用方
+	done           chan struct{}      //请求结束时关闭
+	waiters        int                //仍在等待该请求结果的调用方数量
+	cancel         context.CancelFunc //所有调用方均放弃等待时取消请求
+}
+
+// Group 单次请求组,同一 key 的并发请求只会执行一次,结果由所有调用方共享
+type Group[T any] struct {
+	m          map[string]*call[T] //一类请求与同一类呼叫的映射表
+	sync.Mutex                     //并发控制锁,保证线程安全
+}
+
+func NewGroup[T any]() *Group[T] {
+	return &Group[T]{
+		m: make(map[string]*call[T]),
+	}
+}
+
+// Do 执行请求并返回结果,若该 key 的请求正在进行则等待其结果
+// 请求函数 panic 时所有等待的调用方都会以 *PanicError panic
+func (g *Group[T]) Do(key string, fn func() (T, error)) (v T, err error, shared bool) {
+	g.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*call[T])
+	}
+	//判断以key为关键词的该类请求是否存在
+	if c, ok := g.m[key]; ok {
+		c.dups++
+		c.waiters++
+		g.Unlock()
+		// 如果请求正在进行中，则等待
+		c.Wait()
+		return result(c)
+	}
+	//该类请求不存在,创建个请求
+	c := newCall[T]()
+	g.m[key] = c
+	g.Unlock()
+	//调用请求函数获取内容
+	g.doCall(c, key, fn)
+	return result(c)
+}
+
+// DoChan 与 Do 相同,但立即返回一个通道,请求结束后每个调用方都会从各自的通道中收到结果,
+// 请求函数 panic 时以 *PanicError 作为 Err 传递
+func (g *Group[T]) DoChan(key string, fn func() (T, error)) <-chan Result[T] {
+	ch := make(chan Result[T], 1)
+	g.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*call[T])
+	}
+	if c, ok := g.m[key]; ok {
+		c.dups++
+		c.waiters++
+		c.chans = append(c.chans, ch)
+		g.Unlock()
+		return ch
+	}
+	c := newCall[T]()
+	c.chans = append(c.chans, ch)
+	g.m[key] = c // 添加到 g.m，表明 key 已经有对应的请求在处理
+	g.Unlock()
+	go g.doCall(c, key, fn)
+	return ch
+}
+
+// DoCtx 与 Do 相同,但调用方可在 ctx 结束时放弃等待,请求本身仍为其他调用方继续执行,
+// 传给 fn 的 ctx 只在所有调用方都放弃等待后才会被取消
+func (g *Group[T]) DoCtx(ctx context.Context, key string, fn func(ctx context.Context) (T, error)) (v T, err error, shared bool) {
+	if err = ctx.Err(); err != nil {
+		return v, err, false
+	}
+	g.Lock()
+	if g.m == nil {
+		g.m = make(map[string]*call[T])
+	}
+	c, ok := g.m[key]
+	if ok {
+		c.dups++
+		c.waiters++
+	} else {
+		callCtx, cancel := context.WithCancel(context.Background())
+		c = newCall[T]()
+		c.cancel = cancel
+		g.m[key] = c
+		go g.doCall(c, key, func() (T, error) {
+			defer cancel()
+			return fn(callCtx)
+		})
+	}
+	g.Unlock()
+	select {
+	case <-c.done:
+		return result(c)
+	case <-ctx.Done():
+		// 最后一个放弃等待的调用方负责取消请求,并将其移出请求组,使之后的调用方重新发起请求
+		g.Lock()
+		c.waiters--
+		if c.waiters == 0 && c.cancel != nil {
+			c.cancel()
+			if g.m[key] == c {
+				delete(g.m, key)
+			}
+		}
+		g.Unlock()
+		return v, ctx.Err(), false
+	}
+}
+
+// Forget 使该 key 之后的请求重新执行,不影响正在等待当前请求的调用方
+func (g *Group[T]) Forget(key string) {
+	g.Lock()
+	delete(g.m, key)
+	g.Unlock()
+}
+
+func newCall[T any]() *call[T] {
+	c := &call[T]{
+		done:    make(chan struct{}),
+		waiters: 1,
+	}
+	// 发起请求前加锁,并将请求添加到请求组内以表示该类请求正在处理
+	c.Add(1)
+	return c
+}
+
+// 执行请求函数,结束后通知所有调用方并从请求组中删除该呼叫请求
+func (g *Group[T]) doCall(c *call[T], key string, fn func() (T, error)) {
+	normalReturn := false
+	recovered := false
+	defer func() {
+		if !normalReturn && !recovered {
+			// 既未正常返回也未 panic,只能是调用了 runtime.Goexit
+			c.err = ErrGoexit
+		}
+		g.Lock()
+		defer g.Unlock()
+		//请求结束
+		c.Done()
+		close(c.done)
+		if g.m[key] == c {
+			delete(g.m, key)
+		}
+		for _, ch := range c.chans {
+			ch <- Result[T]{Val: c.val, Err: c.err, Shared: c.dups > 0}
+		}
+	}()
+	func() {
+		defer func() {
+			if !normalReturn {
+				if r := recover(); r != nil {
+					c.err = newPanicError(r)
+				}
+			}
+		}()
+		c.val, c.err = fn()
+		normalReturn = true
+	}()
+	if !normalReturn {
+		recovered = true
+	}
+}
+
+// 获取请求结果,请求函数 panic 时在调用方重新 panic
+func result[T any](c *call[T]) (T, error, bool) {
+	if e, ok := c.err.(*PanicError); ok {
+		panic(e)
+	}
+	return c.val, c.err, c.dups > 0
+}
@@ -1,107 +1,475 @@
 package ssTable
 
 import (
-	"github.com/hlccd/hlsm/cache"
+	"context"
+	"errors"
 	"github.com/hlccd/hlsm/kv"
+	"github.com/hlccd/hlsm/rateLimiter"
 	"log"
-	"os"
+	"sort"
+	"sync/atomic"
 	"time"
 )
 
+/*
+压缩:
+每次由压缩策略根据区块树的状态选出输入及输出层,合并后写入输出层或转为顶级区块,策略见 policy.go
+*/
+
+// ErrClosed 区块树已关闭,无法继续压缩
+var ErrClosed = errors.New("区块树已关闭")
+
+// ErrTopBlocksSkipped 各层已压缩完成,但压缩前已有的顶级区块与范围重叠,其中的内容未被重写
+var ErrTopBlocksSkipped = errors.New("与范围重叠的顶级区块未被压缩")
+
+const (
+	positionSize = 48 // 稀疏索引区中一个元素定位编码后除 key 外的大致长度
+)
+
+// 一次压缩的输入与输出
+type compaction struct {
+	level       int        // 输入所在层
+	outputLevel int        // 输出层,等于 levelSize 时输出为顶级区块
+	inputs      []*SSTable // 输入所在层中被选中的区块,由旧到新排列
+	overlaps    []*SSTable // 输出层中与输入重叠的区块
+	move        bool       // 输出层中没有重叠的区块,直接移动文件而无需合并
+	drop        bool       // 直接删除输入而不写入输出层
+	split       bool       // 合并结果按目标文件大小切分为多个互不重叠的区块,否则写为一个区块
+	score       float64    // 选中时的压缩分数
+}
+
 // Compaction 检查是否需要压缩 SSTable
 func (tree *TableTree) Compaction(level int) {
-	if level >= tree.levelSize {
-		// 超过上限,结束
-		return
+	_ = tree.CompactionCtx(context.Background(), level)
+}
+
+// CompactionCtx 由压缩策略每次选出第 level 层及以下的一次压缩并执行,直到没有需要压缩的内容,
+// 在读取每个区块前及写入新区块前检查 ctx,ctx 结束时放弃本次压缩并返回其错误,已完成的压缩不受影响
+func (tree *TableTree) CompactionCtx(ctx context.Context, level int) error {
+	for {
+		done, err := tree.compactOnce(ctx, func() *compaction {
+			return tree.pickCompaction(level)
+		})
+		if done || err != nil {
+			return err
+		}
+	}
+}
+
+// CompactRangeCtx 将与 [start, end) 重叠的区块由上至下逐层压缩到最下一层,end 为空时表示不设上限,
+// 最下一层中重叠的区块合并为顶级区块,每完成一层调用 progress 报告已完成的层数及总层数,
+// ctx 结束时放弃本次压缩并返回其错误,已完成的层不受影响。
+// 顶级区块只追加不合并,压缩前已有的顶级区块中范围内被覆盖或删除的元素仍占用空间,
+// 存在与范围重叠的此类顶级区块时,各层压缩完成后返回 ErrTopBlocksSkipped
+func (tree *TableTree) CompactRangeCtx(ctx context.Context, start, end string, progress func(done, total int)) error {
+	tree.RLock()
+	levels := tree.levelSize
+	tops := tree.topBlockNum
+	tree.RUnlock()
+	for level := 0; level < levels; level++ {
+		_, err := tree.compactOnce(ctx, func() *compaction {
+			tree.Lock()
+			defer tree.Unlock()
+			return tree.policy.pickRange(tree, level, start, end)
+		})
+		if err != nil {
+			return err
+		}
+		if progress != nil {
+			progress(level+1, levels)
+		}
+	}
+	if tree.topBlocksOverlap(tops, start, end) {
+		return ErrTopBlocksSkipped
 	}
-	tableSize := int(tree.GetLevelSize(level) / 1024 / 1024) // 转为 MB
-	// 当前层 SSTable 数量是否已经到达阈值
-	// 当前层的 SSTable 总大小已经到底阈值
-	if tree.getCount(level) < partSize && tableSize < tree.levelMaxSize[level] {
-		return
+	return nil
+}
+
+// 编号不超过 num 的顶级区块中是否有与 [start, end) 重叠的区块,end 为空时表示不设上限
+func (tree *TableTree) topBlocksOverlap(num int, start, end string) bool {
+	tree.loadTopBlockRanges()
+	tree.RLock()
+	defer tree.RUnlock()
+	for index := 1; index <= num; index++ {
+		r := tree.topBlockRanges[index]
+		if r.bounded && (end == "" || r.start < end) && start < r.limit {
+			return true
+		}
 	}
+	return false
+}
 
-	// 压完本层后继续压下一层
-	defer tree.Compaction(level + 1)
-	log.Println("正在压实第", level, "层的内容")
+// 选出并执行一次压缩,同一区块树同时只执行一次压缩,没有需要压缩的内容时 done 为 true
+func (tree *TableTree) compactOnce(ctx context.Context, pick func() *compaction) (done bool, err error) {
+	tree.compactLock.Lock()
+	defer tree.compactLock.Unlock()
+	if err = ctx.Err(); err != nil {
+		return false, err
+	}
+	if tree.closed {
+		return false, ErrClosed
+	}
+	c := pick()
+	if c == nil {
+		return true, nil
+	}
+	return false, tree.runCompaction(ctx, c)
+}
+
+// 合并输出的单个区块的目标大小
+func (tree *TableTree) fileTarget() int64 {
+	return tree.cap * 2
+}
+
+// 由压缩策略选出一次压缩,没有需要压缩的内容时返回 nil
+func (tree *TableTree) pickCompaction(from int) *compaction {
+	tree.Lock()
+	defer tree.Unlock()
+	return tree.policy.pick(tree, from)
+}
+
+// 一组区块的 key 范围的并集
+func spanOf(tables []*SSTable) (start, limit string, ok bool) {
+	for _, table := range tables {
+		if !table.bounded {
+			continue
+		}
+		if !ok || table.boundStart < start {
+			start = table.boundStart
+		}
+		if !ok || table.boundLimit > limit {
+			limit = table.boundLimit
+		}
+		ok = true
+	}
+	return start, limit, ok
+}
+
+// 执行一次压缩
+func (tree *TableTree) runCompaction(ctx context.Context, c *compaction) error {
+	if c.drop {
+		tree.drop(c)
+		return nil
+	}
+	if c.move {
+		tree.move(c)
+		return nil
+	}
+	log.Println("正在压实第", c.level, "层的内容")
 	start := time.Now()
 	defer func() {
 		elapse := time.Since(start)
-		log.Printf("压实第%d层耗时:%d\n", level, elapse)
+		log.Printf("压实第%d层耗时:%d\n", c.level, elapse)
 	}()
-	// 用于加载 一个 SSTable 的数据区到缓存中
-	tableCache := make([]byte, tree.levelMaxSize[level])
-	currentNode := tree.levels[level]
 
-	// 将当前层的 SSTable 合并到缓存中
-	c := cache.NewLRU(tree.cap)
+	tree.loadTopBlockRanges()
+	tree.RLock()
+	tables := tree.byRecency(c)
+	job := &mergeJob{
+		tree:        tree,
+		level:       c.level,
+		tables:      tables,
+		filter:      tree.filter,
+		bottommost:  tree.bottommost(c),
+		limiter:     tree.limiter,
+		outputLevel: c.outputLevel,
+		split:       c.split,
+		nextIndex:   int64(tree.levelSize),
+	}
+	job.older, job.gc = tree.olderRanges(c)
+	if c.outputLevel < tree.levelSize {
+		job.nextIndex = int64(tree.levelNextIndex(c.outputLevel))
+	} else {
+		job.nextIndex = int64(tree.topBlockNum + 1)
+	}
+	workers := tree.subcompactions
+	tree.RUnlock()
 
+	// 输出为顶级区块或不切分时只有一个子压缩
+	bounds := []string{"", ""}
+	if c.split && c.outputLevel < tree.levelSize {
+		bounds = tree.splitBounds(tables, workers)
+	}
+	spans, err := tree.runSpans(ctx, job, bounds, workers)
+	if err != nil {
+		return err
+	}
+	dropped := 0
+	outputs := make([]*Table, 0)
+	for _, sp := range spans {
+		dropped += sp.dropped
+		outputs = append(outputs, sp.outputs...)
+	}
+	log.Printf("压实第%d层丢弃了%d个删除标记\n", c.level, dropped)
+	// 各子压缩并发分配索引,按索引排列后才能依次挂入输出层
+	sort.Slice(outputs, func(i, j int) bool {
+		return outputs[i].index < outputs[j].index
+	})
+	tree.install(c, outputs)
 	tree.Lock()
-	// 遍历该层所有区块,从硬盘中读取所有信息进行构建有序集合
-	for currentNode != nil {
-		table := currentNode.table
-		// 将 SSTable 的数据区加载到 tableCache 内存中
-		if int64(len(tableCache)) < table.tableMetaInfo.dataLen {
-			tableCache = make([]byte, table.tableMetaInfo.dataLen)
-		}
-		newSlice := tableCache[0:table.tableMetaInfo.dataLen]
-		// 读取 SSTable 的数据区
-		if _, err := table.f.Seek(0, 0); err != nil {
-			log.Println("打开 db 文件失败", table.filePath)
-			panic(err)
-		}
-		if _, err := table.f.Read(newSlice); err != nil {
-			log.Println("读取 db 文件失败", table.filePath)
-			panic(err)
-		}
-		// 读取每一个元素
-		for k, position := range table.sparseIndex {
-			if position.Deleted == false {
-				value, err := kv.Decode(newSlice[position.Start:(position.Start + position.Len)])
-				if err != nil {
-					log.Fatal(err)
-				}
-				c.Insert(k, value.Value)
-			} else {
-				c.Erase(k)
+	tree.compactStats.Compactions++
+	tree.compactStats.TombstonesDropped += int64(dropped)
+	tree.Unlock()
+	return nil
+}
+
+// 将压缩的输入由旧到新排列,合并时同一 key 以最新区块中的版本为准,
+// 输出层中的区块比输入更旧,同一层中按节点索引排列,索引越大越新,调用方需持有锁
+func (tree *TableTree) byRecency(c *compaction) []*SSTable {
+	tables := make([]*SSTable, 0, len(c.overlaps)+len(c.inputs))
+	collect := func(level int, picked []*SSTable) {
+		set := make(map[*SSTable]bool, len(picked))
+		for _, table := range picked {
+			set[table] = true
+		}
+		for node := tree.levels[level]; node != nil; node = node.next {
+			if set[node.table] {
+				tables = append(tables, node.table)
 			}
 		}
-		currentNode = currentNode.next
 	}
-	tree.Unlock()
+	if c.outputLevel < tree.levelSize {
+		collect(c.outputLevel, c.overlaps)
+	}
+	collect(c.level, c.inputs)
+	return tables
+}
+
+// 一次压缩中各子压缩共用的输入及配置
+type mergeJob struct {
+	tree        *TableTree
+	level       int                  // 输入所在层
+	tables      []*SSTable           // 由旧到新排列的区块
+	filter      CompactionFilter     // 压缩过滤器
+	bottommost  bool                 // 输出之下是否不再有更旧的数据
+	older       []keyRange           // 更旧的区块的 key 范围
+	gc          bool                 // older 是否完整,完整时才能回收删除标记
+	limiter     *rateLimiter.Limiter // 读写区块的限速器
+	outputLevel int                  // 输出层,等于 levelSize 时输出为顶级区块
+	split       bool                 // 是否按目标文件大小切分输出
+	nextIndex   int64                // 下一个输出区块的索引,由各子压缩并发分配
+}
 
-	// 将 SortTree 压缩合并成一个 SSTable
-	values := c.ClearAndGainSorted()
+// 一个子压缩的 key 范围 [start, end) 及其输出,end 为空时表示不设上限
+type span struct {
+	start, end string
+	outputs    []*Table // 写入输出层的区块,尚未挂入区块树
+	dropped    int      // 丢弃的删除标记数量
+}
 
-	if level+1 >= tree.levelSize {
-		// 超过层级上限,应当设为顶级区块
-		tree.Storage(values)
+// 以多路归并逐个读取 key 在 sp 范围内的元素,应用压缩过滤器并回收删除标记后逐个写入输出区块,
+// 内存中只保留每个区块的一块数据及正在写入的区块的稀疏索引,失败时删除已写入的区块
+func (job *mergeJob) run(ctx context.Context, sp *span) error {
+	m, err := newMergeIterator(ctx, job.tables, sp.start, sp.end, job.limiter)
+	if err != nil {
+		return err
+	}
+	ranges := m.rangeDels()
+	if job.gc {
+		ranges, sp.dropped = dropRanges(ranges, job.older)
+	}
+	out := &output{job: job, sp: sp, ranges: ranges}
+	for {
+		value, err := m.next(ctx)
+		if err != nil {
+			out.abort()
+			return err
+		}
+		if value == nil {
+			break
+		}
+		value, keep := filterValue(job.filter, job.level, job.bottommost, value)
+		if !keep {
+			continue
+		}
+		if value.Deleted && job.gc && !mayExist(job.older, value.Key, value.Key+"\x00") {
+			sp.dropped++
+			continue
+		}
+		out.add(value)
+	}
+	if err = ctx.Err(); err != nil {
+		out.abort()
+		return err
+	}
+	out.finish()
+	return nil
+}
+
+// 子压缩的输出,切分时写入输出层的区块按目标文件大小切分,顶级区块按 capMax 切分
+type output struct {
+	job    *mergeJob
+	sp     *span
+	ranges []kv.RangeTombstone // 子压缩范围内的范围删除标记
+	w      *tableWriter        // 正在写入的区块
+	index  int                 // 正在写入的区块的索引
+	start  string              // 正在写入的区块的起始位置,范围删除标记按其截断
+	full   bool                // 正在写入的区块已达到目标文件大小,写入下一个元素前需结束
+}
+
+func (out *output) top() bool {
+	return out.job.outputLevel >= out.job.tree.levelSize
+}
+
+// 写入一个元素,key 需大于已写入的 key
+func (out *output) add(value *kv.Value) {
+	if out.full {
+		// 正在写入的区块覆盖到下一个区块的第一个 key 之前
+		out.close(value.Key)
+	}
+	if out.w == nil {
+		out.open()
+	}
+	out.w.add(value)
+	out.full = out.job.split && out.w.size >= out.target()
+}
+
+// 输出区块的目标大小
+func (out *output) target() int64 {
+	if out.top() {
+		return out.job.tree.capMax
+	}
+	return out.job.tree.fileTarget()
+}
+
+// 开始写入新的区块,第一个区块向前覆盖子压缩范围内的所有范围删除标记
+func (out *output) open() {
+	tree := out.job.tree
+	out.index = int(atomic.AddInt64(&out.job.nextIndex, 1) - 1)
+	if out.top() {
+		out.w = newTableWriter(tree.fs, tree.topBlockPath(out.index), out.job.limiter)
+	} else {
+		out.w = newTableWriter(tree.fs, tree.tablePath(out.job.outputLevel, out.index), out.job.limiter)
+	}
+	if len(out.sp.outputs) == 0 {
+		out.start = out.sp.start
+	}
+}
+
+// 结束正在写入的区块,范围删除标记截断到 [start, end) 内
+func (out *output) close(end string) {
+	tree := out.job.tree
+	ss := out.w.finish(clipRanges(out.ranges, out.start, end))
+	out.w, out.full, out.start = nil, false, end
+	if out.top() {
+		// 顶级区块不常驻打开,在挂入时才计入
+		log.Printf("创建了一个顶级区块: %d\n", out.index)
 	} else {
-		// 创建新的 SSTable
-		tree.Insert(values, level+1)
+		ss.level = out.job.outputLevel
+		ss.blocks = tree.blocks
+		ss.open(tree.mmap)
+		log.Printf("创建了一个新区块,level: %d ,index: %d\r\n", out.job.outputLevel, out.index)
+	}
+	out.sp.outputs = append(out.sp.outputs, NewTable(out.index, ss))
+}
+
+// 结束输出,最后一个区块向后覆盖子压缩范围内的所有范围删除标记,没有元素但有范围删除标记时只写入范围删除标记
+func (out *output) finish() {
+	if out.w == nil && len(out.sp.outputs) == 0 && len(out.ranges) > 0 {
+		out.open()
+	}
+	if out.w != nil {
+		out.close(out.sp.end)
+	}
+}
+
+// 放弃输出,删除已写入的区块
+func (out *output) abort() {
+	if out.w != nil {
+		out.w.abort()
+		out.w = nil
+	}
+	out.sp.discard(out.job.tree)
+}
+
+// 将范围删除标记截断到 [start, end) 内,end 为空时表示不设上限
+func clipRanges(ranges []kv.RangeTombstone, start, end string) []kv.RangeTombstone {
+	clipped := make([]kv.RangeTombstone, 0)
+	for _, r := range ranges {
+		if r.Start < start {
+			r.Start = start
+		}
+		if end != "" && r.End > end {
+			r.End = end
+		}
+		if r.Start < r.End {
+			clipped = append(clipped, r)
+		}
 	}
-	// 清理并重置该层文件
-	tree.clearLevel(tree.levels[level])
-	tree.levels[level] = nil
+	return clipped
 }
 
-func (tree *TableTree) clearLevel(oldNode *Table) {
+// 以输出替换输入,与并发的查找互斥,查找不会读到已关闭的文件
+func (tree *TableTree) install(c *compaction, outputs []*Table) {
 	tree.Lock()
 	defer tree.Unlock()
-	// 清理当前层的每个的 SSTable
-	for oldNode != nil {
-		err := oldNode.table.f.Close()
-		if err != nil {
-			log.Println("关闭文件失败:", oldNode.table.filePath)
-			panic(err)
+	for _, node := range outputs {
+		tree.written.Compacted += node.table.size()
+	}
+	tree.unlink(c.level, c.inputs)
+	if c.outputLevel < tree.levelSize {
+		tree.unlink(c.outputLevel, c.overlaps)
+		for _, node := range outputs {
+			tree.appendNode(node, c.outputLevel)
 		}
-		err = os.Remove(oldNode.table.filePath)
-		if err != nil {
-			log.Println("删除文件失败:", oldNode.table.filePath)
-			panic(err)
+	} else {
+		for _, node := range outputs {
+			tree.topBlockNum = node.index
+			tree.topBlockRanges[node.index] = node.table.keyRange()
 		}
-		oldNode.table.f = nil
-		oldNode.table = nil
-		oldNode = oldNode.next
+	}
+	for _, table := range c.inputs {
+		tree.remove(table)
+	}
+	for _, table := range c.overlaps {
+		tree.remove(table)
+	}
+}
+
+// 将区块直接移动到下一层
+func (tree *TableTree) move(c *compaction) {
+	tree.Lock()
+	defer tree.Unlock()
+	table := c.inputs[0]
+	tree.unlink(c.level, c.inputs)
+	if err := table.close(); err != nil {
+		log.Println("关闭文件失败:", table.filePath)
+		panic(err)
+	}
+	index := tree.levelNextIndex(c.outputLevel)
+	p := tree.tablePath(c.outputLevel, index)
+	log.Printf("将区块 %s 移动到第 %d 层\n", table.filePath, c.outputLevel)
+	if err := tree.fs.Rename(table.filePath, p); err != nil {
+		log.Println("移动文件失败:", table.filePath)
+		panic(err)
+	}
+	table.filePath = p
+	table.level = c.outputLevel
+	table.open(tree.mmap)
+	tree.appendNode(NewTable(index, table), c.outputLevel)
+}
+
+// 从区块树中移除输入并删除其文件
+func (tree *TableTree) drop(c *compaction) {
+	tree.Lock()
+	defer tree.Unlock()
+	tree.unlink(c.level, c.inputs)
+	for _, table := range c.inputs {
+		log.Println("丢弃区块", table.filePath)
+		tree.remove(table)
+	}
+}
+
+// 关闭并删除已从区块树中移除的区块文件,调用方需持有锁
+func (tree *TableTree) remove(table *SSTable) {
+	err := table.close()
+	if err != nil {
+		log.Println("关闭文件失败:", table.filePath)
+		panic(err)
+	}
+	err = tree.fs.Remove(table.filePath)
+	if err != nil {
+		log.Println("删除文件失败:", table.filePath)
+		panic(err)
 	}
 }
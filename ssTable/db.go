@@ -1,9 +1,8 @@
 package ssTable
 
 import (
-	"encoding/binary"
+	"github.com/hlccd/hlsm/vfs"
 	"log"
-	"os"
 )
 
 /*
@@ -12,7 +11,7 @@ import (
 
 // GetDbSize 获取 .db 数据文件大小
 func (ss *SSTable) GetDbSize() int64 {
-	info, err := os.Stat(ss.filePath)
+	info, err := ss.fs.Stat(ss.filePath)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -24,39 +23,47 @@ func (tree *TableTree) GetLevelSize(level int) int64 {
 	var size int64
 	node := tree.levels[level]
 	for node != nil {
-		size += node.table.GetDbSize()
+		size += node.table.size()
 		node = node.next
 	}
 	return size
 }
 
 // 将数据写入文件
-func writeDataToFile(filePath string, dataArea []byte, indexArea []byte, meta MetaInfo) {
-	f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0666)
+func writeDataToFile(fs vfs.FS, filePath string, dataArea []byte, indexArea []byte, rangeArea []byte, meta MetaInfo) {
+	f, err := fs.Create(filePath)
 	if err != nil {
-		log.Fatal("创建文件失败,", err)
+		log.Println("创建文件失败:", filePath)
+		panic(err)
 	}
 	_, err = f.Write(dataArea)
 	if err != nil {
-		log.Fatal("写入文件失败,", err)
+		log.Println("写入文件失败:", filePath)
+		panic(err)
 	}
 	_, err = f.Write(indexArea)
 	if err != nil {
-		log.Fatal("写入文件失败,", err)
+		log.Println("写入文件失败:", filePath)
+		panic(err)
+	}
+	_, err = f.Write(rangeArea)
+	if err != nil {
+		log.Println("写入文件失败:", filePath)
+		panic(err)
 	}
 	// 写入元数据到文件末尾
-	// 注意，右侧必须能够识别字节长度的类型，不能使用 int 这种类型，只能使用 int32、int64 等
-	_ = binary.Write(f, binary.LittleEndian, meta.version)
-	_ = binary.Write(f, binary.LittleEndian, meta.dataStart)
-	_ = binary.Write(f, binary.LittleEndian, meta.dataLen)
-	_ = binary.Write(f, binary.LittleEndian, meta.indexStart)
-	_ = binary.Write(f, binary.LittleEndian, meta.indexLen)
+	if err = writeMeta(f, meta); err != nil {
+		log.Println("写入文件失败:", filePath)
+		panic(err)
+	}
 	err = f.Sync()
 	if err != nil {
-		log.Fatal("写入文件失败,", err)
+		log.Println("写入文件失败:", filePath)
+		panic(err)
 	}
 	err = f.Close()
 	if err != nil {
-		log.Fatal("关闭文件失败,", err)
+		log.Println("关闭文件失败:", filePath)
+		panic(err)
 	}
 }
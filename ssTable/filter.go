@@ -0,0 +1,56 @@
+package ssTable
+
+import "github.com/hlccd/hlsm/kv"
+
+// FilterDecision 压缩过滤器对一个元素的处理方式
+type FilterDecision int
+
+const (
+	Keep        FilterDecision = iota // 保留原值
+	Remove                            // 删除该元素,非最下层的压缩中转为删除标记,以免更旧的值重新可见
+	ChangeValue                       // 以过滤器返回的新值替换原值
+)
+
+// CompactionFilter 压缩过滤器,在合并区块时对每个未被删除的元素调用,可用于过期或改写数据,
+// level 为压缩输入所在的层,bottommost 表示输出之下不再有更旧的数据,直接移动的区块不经过滤器
+type CompactionFilter interface {
+	Filter(level int, bottommost bool, key string, value any) (decision FilterDecision, newValue any)
+}
+
+// SetCompactionFilter 设置压缩过滤器,为 nil 时不过滤
+func (tree *TableTree) SetCompactionFilter(filter CompactionFilter) {
+	tree.Lock()
+	defer tree.Unlock()
+	tree.filter = filter
+}
+
+// 输出之下是否不再有更旧的数据,即更下的层及顶级区块均为空,调用方需持有锁
+func (tree *TableTree) bottommost(c *compaction) bool {
+	if c.outputLevel >= tree.levelSize {
+		return tree.topBlockNum == 0
+	}
+	for level := c.outputLevel + 1; level < tree.levelSize; level++ {
+		if tree.levels[level] != nil {
+			return false
+		}
+	}
+	return tree.topBlockNum == 0
+}
+
+// 对合并出的一个元素应用压缩过滤器,元素被丢弃时返回 false
+func filterValue(filter CompactionFilter, level int, bottommost bool, v *kv.Value) (*kv.Value, bool) {
+	if filter == nil || v.Deleted {
+		return v, true
+	}
+	decision, newValue := filter.Filter(level, bottommost, v.Key, v.Value)
+	switch decision {
+	case Remove:
+		if bottommost {
+			return nil, false
+		}
+		return kv.NewValue(v.Key, nil, true), true
+	case ChangeValue:
+		return kv.NewValue(v.Key, newValue, false), true
+	}
+	return v, true
+}
@@ -0,0 +1,189 @@
+package ssTable
+
+import (
+	"container/heap"
+	"context"
+	"github.com/hlccd/hlsm/kv"
+	"github.com/hlccd/hlsm/rateLimiter"
+	"log"
+)
+
+// 迭代器每次从数据区读取的字节数,单个元素更长时按元素长度读取
+const iteratorBlockSize = 64 * 1024
+
+// tableIterator 按 key 升序遍历区块中 [start, end) 内的元素,每次从数据区读取一块,
+// 数据区已映射到内存时直接使用映射的切片
+type tableIterator struct {
+	table    *SSTable
+	order    int      // 区块在合并中由旧到新的序号,越大越新
+	keys     []string // 待遍历的 key
+	buf      []byte   // 已读取的数据区内容
+	bufStart int64    // buf 在数据区中的起始位置
+	limiter  *rateLimiter.Limiter
+	value    *kv.Value // 当前元素
+}
+
+func newTableIterator(table *SSTable, order int, start, end string, limiter *rateLimiter.Limiter) *tableIterator {
+	return &tableIterator{
+		table:   table,
+		order:   order,
+		keys:    table.keysIn(start, end),
+		limiter: limiter,
+	}
+}
+
+// 移动到下一个元素,没有更多元素时返回 false
+func (it *tableIterator) next(ctx context.Context) (bool, error) {
+	if len(it.keys) == 0 {
+		it.value = nil
+		return false, nil
+	}
+	key := it.keys[0]
+	it.keys = it.keys[1:]
+	position := it.table.sparseIndex[key]
+	data, err := it.read(ctx, position)
+	if err != nil {
+		return false, err
+	}
+	if position.Deleted {
+		it.value = kv.NewValue(key, nil, true)
+		return true, nil
+	}
+	value, err := kv.Decode(data)
+	if err != nil {
+		log.Fatal(err)
+	}
+	it.value = kv.NewValue(key, value.Value, false)
+	return true, nil
+}
+
+// 读取指定位置的内容,不在已读取的块中时读取以其为起点的下一块
+func (it *tableIterator) read(ctx context.Context, position Position) ([]byte, error) {
+	table := it.table
+	if table.data != nil {
+		return table.data[position.Start : position.Start+position.Len], nil
+	}
+	end := position.Start + position.Len
+	if position.Start < it.bufStart || end > it.bufStart+int64(len(it.buf)) {
+		n := int64(iteratorBlockSize)
+		if n < position.Len {
+			n = position.Len
+		}
+		if rest := table.tableMetaInfo.dataLen - position.Start; n > rest {
+			n = rest
+		}
+		// 读取前按限速等待
+		if err := it.limiter.WaitCtx(ctx, n); err != nil {
+			return nil, err
+		}
+		if int64(cap(it.buf)) < n {
+			it.buf = make([]byte, n)
+		}
+		it.buf = it.buf[:n]
+		if err := readAt(table.f, it.buf, position.Start); err != nil {
+			log.Println("读取 db 文件失败", table.filePath)
+			panic(err)
+		}
+		it.bufStart = position.Start
+	}
+	return it.buf[position.Start-it.bufStart : end-it.bufStart], nil
+}
+
+// 多路归并的堆,key 相同时更新的区块在前
+type iteratorHeap []*tableIterator
+
+func (h iteratorHeap) Len() int { return len(h) }
+func (h iteratorHeap) Less(i, j int) bool {
+	if h[i].value.Key != h[j].value.Key {
+		return h[i].value.Key < h[j].value.Key
+	}
+	return h[i].order > h[j].order
+}
+func (h iteratorHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *iteratorHeap) Push(x any)   { *h = append(*h, x.(*tableIterator)) }
+func (h *iteratorHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// mergeIterator 对多个由旧到新排列的区块做多路归并,按 key 升序依次给出每个 key 最新的版本,
+// 被更新的区块中的范围删除标记覆盖的元素及被任一范围删除标记覆盖的删除标记均不再给出,
+// 范围删除标记本身会保留在输出中,依然能覆盖更旧的区块
+type mergeIterator struct {
+	h      iteratorHeap
+	ranges [][]kv.RangeTombstone // 各区块截断到合并范围内的范围删除标记,下标为区块序号
+	all    []kv.RangeTombstone   // 所有区块合并后的范围删除标记
+}
+
+// 创建遍历 [start, end) 内元素的多路归并迭代器,end 为空时表示不设上限
+func newMergeIterator(ctx context.Context, tables []*SSTable, start, end string, limiter *rateLimiter.Limiter) (*mergeIterator, error) {
+	m := &mergeIterator{
+		h:      make(iteratorHeap, 0, len(tables)),
+		ranges: make([][]kv.RangeTombstone, len(tables)),
+	}
+	for i, table := range tables {
+		m.ranges[i] = clipRanges(table.rangeDels, start, end)
+		m.all = append(m.all, m.ranges[i]...)
+		it := newTableIterator(table, i, start, end, limiter)
+		ok, err := it.next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			m.h = append(m.h, it)
+		}
+	}
+	m.all = kv.MergeRanges(m.all)
+	heap.Init(&m.h)
+	return m, nil
+}
+
+// 合并后的范围删除标记
+func (m *mergeIterator) rangeDels() []kv.RangeTombstone {
+	return m.all
+}
+
+// 下一个元素,没有更多元素时返回 nil
+func (m *mergeIterator) next(ctx context.Context) (*kv.Value, error) {
+	for m.h.Len() > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		// 堆顶为该 key 最新的版本,跳过其余区块中的旧版本
+		top := m.h[0]
+		value, order := top.value, top.order
+		for m.h.Len() > 0 && m.h[0].value.Key == value.Key {
+			it := m.h[0]
+			ok, err := it.next(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				heap.Fix(&m.h, 0)
+			} else {
+				heap.Pop(&m.h)
+			}
+		}
+		if value.Deleted {
+			if kv.Covered(m.all, value.Key) {
+				continue
+			}
+		} else if m.coveredAfter(order, value.Key) {
+			continue
+		}
+		return value, nil
+	}
+	return nil, nil
+}
+
+// key 是否被序号大于 order 的区块中的范围删除标记覆盖
+func (m *mergeIterator) coveredAfter(order int, key string) bool {
+	for i := order + 1; i < len(m.ranges); i++ {
+		if kv.Covered(m.ranges[i], key) {
+			return true
+		}
+	}
+	return false
+}
@@ -3,17 +3,25 @@ package ssTable
 /*
 
 索引是从数据区开始！
-0 ─────────────────────────────────────────────────────────►
+0 ──────────────────────────────────────────────────────────────────────────►
 ◄───────────────────────────
           dataLen          ◄──────────────────
-                                indexLen     ◄──────────────┐
-┌──────────────────────────┬─────────────────┬──────────────┤
-│                          │                 │              │
-│          数据区           │   稀疏索引区      │    元数据     │
-│                          │                 │              │
-└──────────────────────────┴─────────────────┴──────────────┘
+                                indexLen     ◄────────────────
+                                                  rangeLen    ◄──────────────┐
+┌──────────────────────────┬─────────────────┬────────────────┬──────────────┤
+│                          │                 │                │              │
+│          数据区           │   稀疏索引区      │  范围删除标记区   │    元数据     │
+│                          │                 │                │              │
+└──────────────────────────┴─────────────────┴────────────────┴──────────────┘
+
+元数据自文件末尾向前依次为 indexLen、indexStart、dataLen、dataStart、version,
+version 为 1 及以上时再向前为 rangeLen、rangeStart,版本 0 的文件没有范围删除标记区
 */
 
+const (
+	metaVersion = 1 // 当前写入的元数据版本
+)
+
 // MetaInfo 是 SSTable 的元数据，
 // 元数据出现在磁盘文件的末尾
 type MetaInfo struct {
@@ -27,14 +35,20 @@ type MetaInfo struct {
 	indexStart int64
 	// 稀疏索引区长度
 	indexLen int64
+	// 范围删除标记区起始索引
+	rangeStart int64
+	// 范围删除标记区长度
+	rangeLen int64
 }
 
-func NewMetaInfo(dataLen, indexStart, indexLen int64) MetaInfo {
+func NewMetaInfo(dataLen, indexStart, indexLen, rangeLen int64) MetaInfo {
 	return MetaInfo{
-		version:    0,
+		version:    metaVersion,
 		dataStart:  0,
 		dataLen:    dataLen,
 		indexStart: indexStart,
 		indexLen:   indexLen,
+		rangeStart: indexStart + indexLen,
+		rangeLen:   rangeLen,
 	}
 }
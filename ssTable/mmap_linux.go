@@ -0,0 +1,23 @@
+//go:build linux
+
+package ssTable
+
+import (
+	"errors"
+	"github.com/hlccd/hlsm/vfs"
+	"os"
+	"syscall"
+)
+
+// 以只读方式映射文件的前 size 个字节,只有硬盘上的文件可以映射
+func mmapFile(f vfs.File, size int64) ([]byte, error) {
+	osFile, ok := f.(*os.File)
+	if !ok {
+		return nil, errors.New("文件不在硬盘上,无法映射")
+	}
+	return syscall.Mmap(int(osFile.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
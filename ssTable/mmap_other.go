@@ -0,0 +1,17 @@
+//go:build !linux
+
+package ssTable
+
+import (
+	"errors"
+	"github.com/hlccd/hlsm/vfs"
+)
+
+// 其他平台暂不支持内存映射,SSTable 退回到 ReadAt 读取
+func mmapFile(f vfs.File, size int64) ([]byte, error) {
+	return nil, errors.New("当前平台不支持内存映射")
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,219 @@
+package ssTable
+
+import "sort"
+
+/*
+压缩策略:
+分层(leveled):第 0 层为缓存区直接落盘的区块,相互之间可能重叠,数量达到 partSize 时全部与第 1 层中重叠的区块合并;
+第 1 层及以下每层的区块互不重叠,总大小超过该层目标大小时轮流选出一个区块,与下一层中重叠的区块合并,
+合并结果按目标文件大小切分为多个互不重叠的区块放入下一层;最后一层超过目标大小时全部合并为多个大小约为 capMax 的顶级区块。
+读放大与空间放大小,写放大大,适合读多写少的场景
+分级(tiered,即 universal):每层的区块数量达到 partSize 时全部合并为下一层的一个区块,不与下一层已有的区块合并,
+最后一层则合并为一个顶级区块。每个元素在每层只被写入一次,写放大小,读放大与空间放大大,适合写入密集的场景
+先进先出(fifo):从不合并,所有区块总大小超过上限时删除最旧的区块,适合只保留最近数据的时序缓存,顶级区块不计入也不删除
+*/
+
+const levelMultiplier = 10 // 分层压缩中每层的目标大小为上一层的倍数
+
+// CompactionPolicy 压缩策略,根据区块树的状态选出一次压缩的输入及输出层,
+// 方法均不导出,本包之外无法实现,只能通过 NewLeveledPolicy、NewTieredPolicy 及 NewFIFOPolicy 在内置策略中选择
+type CompactionPolicy interface {
+	// 选出第 from 层及以下的一次压缩,没有需要压缩的内容时返回 nil,调用方需持有区块树的锁
+	pick(tree *TableTree, from int) *compaction
+	// 选出第 level 层中与 [start, end) 重叠的区块的一次压缩,用于手动压缩,调用方需持有区块树的锁
+	pickRange(tree *TableTree, level int, start, end string) *compaction
+}
+
+// 第 level 层中与 [start, end) 重叠的区块,调用方需持有锁
+func (tree *TableTree) rangeTables(level int, start, end string) []*SSTable {
+	tables := make([]*SSTable, 0)
+	for _, table := range tree.tables(level) {
+		if table.overlapsRange(start, end) {
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+type leveledPolicy struct{}
+
+// NewLeveledPolicy 分层压缩,默认的压缩策略
+func NewLeveledPolicy() CompactionPolicy {
+	return leveledPolicy{}
+}
+
+// 第 level 层的目标大小,第 1 层为 partSize 个缓存区的大小
+func (tree *TableTree) levelTarget(level int) int64 {
+	target := tree.cap * partSize
+	for i := 1; i < level; i++ {
+		target *= levelMultiplier
+	}
+	return target
+}
+
+// 第 level 层的压缩分数,达到 1 时需要压缩,第 0 层按区块数量计算,其余层按总大小计算
+func (leveledPolicy) score(tree *TableTree, level int) float64 {
+	if level == 0 {
+		return float64(tree.getCount(0)) / partSize
+	}
+	return float64(tree.GetLevelSize(level)) / float64(tree.levelTarget(level))
+}
+
+// 选出分数最高的一层,分数需达到 1
+func (p leveledPolicy) pick(tree *TableTree, from int) *compaction {
+	level, score := -1, 0.0
+	for l := from; l < tree.levelSize; l++ {
+		if s := p.score(tree, l); s >= 1 && s > score {
+			level, score = l, s
+		}
+	}
+	if level < 0 {
+		return nil
+	}
+	c := &compaction{
+		level:       level,
+		outputLevel: level + 1,
+		split:       true,
+		score:       score,
+	}
+	if level == 0 || c.outputLevel >= tree.levelSize {
+		// 第 0 层的区块相互重叠,全部参与合并,最后一层全部合并为顶级区块,避免产生大量小的顶级区块
+		c.inputs = tree.tables(level)
+	} else {
+		c.inputs = []*SSTable{tree.nextCompactTable(level)}
+	}
+	if c.outputLevel >= tree.levelSize {
+		return c
+	}
+	start, limit, ok := spanOf(c.inputs)
+	if ok {
+		for _, table := range tree.tables(c.outputLevel) {
+			if table.overlaps(start, limit) {
+				c.overlaps = append(c.overlaps, table)
+			}
+		}
+	}
+	c.move = len(c.inputs) == 1 && len(c.overlaps) == 0
+	return c
+}
+
+// 第 0 层的区块相互重叠,只要有区块与范围重叠就全部参与合并,否则只选出重叠的区块,
+// 最下一层的区块合并为大小约为 capMax 的顶级区块
+func (leveledPolicy) pickRange(tree *TableTree, level int, start, end string) *compaction {
+	inputs := tree.rangeTables(level, start, end)
+	if len(inputs) == 0 {
+		return nil
+	}
+	if level == 0 {
+		inputs = tree.tables(0)
+	}
+	c := &compaction{
+		level:       level,
+		outputLevel: level + 1,
+		inputs:      inputs,
+		split:       true,
+	}
+	if c.outputLevel >= tree.levelSize {
+		return c
+	}
+	spanStart, spanLimit, ok := spanOf(inputs)
+	if ok {
+		for _, table := range tree.tables(c.outputLevel) {
+			if table.overlaps(spanStart, spanLimit) {
+				c.overlaps = append(c.overlaps, table)
+			}
+		}
+	}
+	c.move = len(c.inputs) == 1 && len(c.overlaps) == 0
+	return c
+}
+
+// 在第 level 层中轮流选出一个区块,选出 key 范围在上次压缩位置之后的第一个区块,没有时从头开始,调用方需持有锁
+func (tree *TableTree) nextCompactTable(level int) *SSTable {
+	tables := tree.tables(level)
+	sort.Slice(tables, func(i, j int) bool {
+		return tables[i].boundStart < tables[j].boundStart
+	})
+	picked := tables[0]
+	for _, table := range tables {
+		if table.boundStart >= tree.compactPointer[level] {
+			picked = table
+			break
+		}
+	}
+	tree.compactPointer[level] = picked.boundLimit
+	return picked
+}
+
+type tieredPolicy struct{}
+
+// NewTieredPolicy 分级压缩
+func NewTieredPolicy() CompactionPolicy {
+	return tieredPolicy{}
+}
+
+// 选出区块数量达到 partSize 的最上一层,该层的区块全部合并为下一层中最新的一个区块
+func (tieredPolicy) pick(tree *TableTree, from int) *compaction {
+	for level := from; level < tree.levelSize; level++ {
+		count := tree.getCount(level)
+		if count < partSize {
+			continue
+		}
+		return &compaction{
+			level:       level,
+			outputLevel: level + 1,
+			inputs:      tree.tables(level),
+			score:       float64(count) / partSize,
+		}
+	}
+	return nil
+}
+
+// 每层的区块相互重叠,只要有区块与范围重叠就将该层全部合并
+func (tieredPolicy) pickRange(tree *TableTree, level int, start, end string) *compaction {
+	if len(tree.rangeTables(level, start, end)) == 0 {
+		return nil
+	}
+	return &compaction{
+		level:       level,
+		outputLevel: level + 1,
+		inputs:      tree.tables(level),
+	}
+}
+
+type fifoPolicy struct {
+	maxSize int64
+}
+
+// NewFIFOPolicy 先进先出,所有区块总大小超过 maxSize 时删除最旧的区块
+func NewFIFOPolicy(maxSize int64) CompactionPolicy {
+	return fifoPolicy{maxSize: maxSize}
+}
+
+// 总大小超过上限时选出最旧的区块,即最下一层中索引最小的区块
+func (p fifoPolicy) pick(tree *TableTree, from int) *compaction {
+	total := int64(0)
+	for level := 0; level < tree.levelSize; level++ {
+		total += tree.GetLevelSize(level)
+	}
+	if total <= p.maxSize {
+		return nil
+	}
+	for level := tree.levelSize - 1; level >= from; level-- {
+		if node := tree.levels[level]; node != nil {
+			return &compaction{
+				level:       level,
+				outputLevel: level,
+				inputs:      []*SSTable{node.table},
+				drop:        true,
+				score:       float64(total) / float64(p.maxSize),
+			}
+		}
+	}
+	return nil
+}
+
+// 先进先出从不合并
+func (fifoPolicy) pickRange(tree *TableTree, level int, start, end string) *compaction {
+	return nil
+}
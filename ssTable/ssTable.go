@@ -3,17 +3,27 @@ package ssTable
 import (
 	"encoding/binary"
 	"encoding/json"
+	"github.com/hlccd/hlsm/cache"
 	"github.com/hlccd/hlsm/kv"
+	"github.com/hlccd/hlsm/vfs"
+	"io"
 	"log"
-	"os"
 	"sort"
-	"sync"
+	"sync/atomic"
 )
 
+// 最近一次分配的 SSTable 编号,用作块缓存中的文件编号,文件名会在压缩后被重复使用故不能作为编号
+var lastTableID uint64
+
+func nextTableID() uint64 {
+	return atomic.AddUint64(&lastTableID, 1)
+}
+
 // SSTable 表，存储在磁盘文件中
 type SSTable struct {
 	// 文件句柄，要注意，操作系统的文件句柄是有限的
-	f        *os.File
+	f        vfs.File
+	fs       vfs.FS
 	filePath string
 	// 元数据
 	tableMetaInfo MetaInfo
@@ -21,24 +31,38 @@ type SSTable struct {
 	sparseIndex map[string]Position
 	// 排序后的 key 列表
 	sortIndex []string
-	// SSTable 只能使排他锁
-	sync.Mutex
+	// 范围删除标记,只作用于比该表更旧的数据
+	rangeDels []kv.RangeTombstone
+	// 编号、所在层级及共享的块缓存,未启用块缓存时 blocks 为 nil
+	id     uint64
+	level  int
+	blocks *cache.BlockCache
+	// 映射到内存的数据区,未映射时为 nil,此时通过 ReadAt 读取
+	data []byte
+	// 区块的 key 范围 [boundStart, boundLimit),包括范围删除标记覆盖的部分,bounded 为 false 时区块为空
+	boundStart, boundLimit string
+	bounded                bool
+	// 读取均通过 ReadAt 进行,不改变文件偏移,故多个协程可同时读取同一个 SSTable 而无需加锁
 	/*
 		sortIndex 是有序的，便于 CPU 缓存等，还可以使用布隆过滤器，有助于快速查找。
 		sortIndex 找到后，使用 sparseIndex 快速定位
 	*/
 }
 
-func NewSSTable(meta MetaInfo, positions map[string]Position, keys []string) *SSTable {
-	return &SSTable{
+func NewSSTable(meta MetaInfo, positions map[string]Position, keys []string, ranges []kv.RangeTombstone) *SSTable {
+	ss := &SSTable{
 		tableMetaInfo: meta,
 		sparseIndex:   positions,
 		sortIndex:     keys,
+		rangeDels:     ranges,
+		id:            nextTableID(),
 	}
+	ss.initBounds()
+	return ss
 }
-func NewSSTableFormLoad(path string) *SSTable {
+func NewSSTableFormLoad(fs vfs.FS, path string) *SSTable {
 	// 以只读的形式打开文件
-	f, err := os.OpenFile(path, os.O_RDONLY, 0666)
+	f, err := fs.Open(path)
 	if err != nil {
 		log.Println("打开文件失败: ", path)
 		panic(err)
@@ -46,68 +70,98 @@ func NewSSTableFormLoad(path string) *SSTable {
 	ss := &SSTable{
 		filePath: path,
 		f:        f,
+		fs:       fs,
+		id:       nextTableID(),
 	}
 
 	// 加载文件句柄的同时，加载表的元数据
 	ss.loadMetaInfo()
 	ss.loadSparseIndex()
+	ss.loadRangeDels()
+	ss.initBounds()
 	return ss
 }
 
-// 加载 SSTable 文件的元数据，从 SSTable 磁盘文件中读取出 TableMetaInfo
-func (ss *SSTable) loadMetaInfo() {
-	f := ss.f
-	_, err := f.Seek(0, 0)
-	if err != nil {
-		log.Println("打开文件失败", ss.filePath)
-		panic(err)
+// 计算区块的 key 范围,最大的 key 之后紧接着的字符串为其加上 "\x00"
+func (ss *SSTable) initBounds() {
+	if len(ss.sortIndex) > 0 {
+		ss.boundStart = ss.sortIndex[0]
+		ss.boundLimit = ss.sortIndex[len(ss.sortIndex)-1] + "\x00"
+		ss.bounded = true
 	}
-	info, _ := f.Stat()
-	_, err = f.Seek(info.Size()-8*5, 0)
-	if err != nil {
-		log.Println("读取元数据失败", ss.filePath)
-		panic(err)
+	for _, r := range ss.rangeDels {
+		if !ss.bounded || r.Start < ss.boundStart {
+			ss.boundStart = r.Start
+		}
+		if !ss.bounded || r.End > ss.boundLimit {
+			ss.boundLimit = r.End
+		}
+		ss.bounded = true
 	}
-	_ = binary.Read(f, binary.LittleEndian, &ss.tableMetaInfo.version)
+}
 
-	_, err = f.Seek(info.Size()-8*4, 0)
-	if err != nil {
-		log.Println("读取元数据失败", ss.filePath)
-		panic(err)
-	}
-	_ = binary.Read(f, binary.LittleEndian, &ss.tableMetaInfo.dataStart)
+// 区块的 key 范围 [start, limit) 是否可能包含 key
+func (ss *SSTable) mayContain(key string) bool {
+	return ss.bounded && ss.boundStart <= key && key < ss.boundLimit
+}
 
-	_, err = f.Seek(info.Size()-8*3, 0)
-	if err != nil {
-		log.Println("Error reading metadata ", ss.filePath)
-		panic(err)
-	}
-	_ = binary.Read(f, binary.LittleEndian, &ss.tableMetaInfo.dataLen)
+// 区块的 key 范围是否与 [start, limit) 有交集
+func (ss *SSTable) overlaps(start, limit string) bool {
+	return ss.bounded && ss.boundStart < limit && start < ss.boundLimit
+}
+
+// 区块的 key 范围是否与 [start, end) 有交集,end 为空时表示不设上限
+func (ss *SSTable) overlapsRange(start, end string) bool {
+	return ss.bounded && (end == "" || ss.boundStart < end) && start < ss.boundLimit
+}
+
+// 区块文件的大小
+func (ss *SSTable) size() int64 {
+	meta := ss.tableMetaInfo
+	return meta.dataLen + meta.indexLen + meta.rangeLen + 8*7
+}
 
-	_, err = f.Seek(info.Size()-8*2, 0)
+// 加载 SSTable 文件的元数据，从 SSTable 磁盘文件末尾读取出 TableMetaInfo
+func (ss *SSTable) loadMetaInfo() {
+	info, err := ss.f.Stat()
 	if err != nil {
-		log.Println("读取元数据失败", ss.filePath)
+		log.Println("打开文件失败", ss.filePath)
 		panic(err)
 	}
-	_ = binary.Read(f, binary.LittleEndian, &ss.tableMetaInfo.indexStart)
-
-	_, err = f.Seek(info.Size()-8*1, 0)
-	if err != nil {
+	// 末尾依次为 rangeStart、rangeLen、version、dataStart、dataLen、indexStart、indexLen,旧版本文件只有后五项
+	tailLen := int64(8 * 7)
+	if info.Size() < tailLen {
+		tailLen = 8 * 5
+	}
+	tail := make([]byte, tailLen)
+	if err = readAt(ss.f, tail, info.Size()-tailLen); err != nil {
 		log.Println("读取元数据失败", ss.filePath)
 		panic(err)
 	}
-	_ = binary.Read(f, binary.LittleEndian, &ss.tableMetaInfo.indexLen)
+	field := func(i int64) int64 {
+		// 自末尾倒数第 i 项
+		off := tailLen - 8*i
+		return int64(binary.LittleEndian.Uint64(tail[off : off+8]))
+	}
+	meta := &ss.tableMetaInfo
+	meta.version = field(5)
+	meta.dataStart = field(4)
+	meta.dataLen = field(3)
+	meta.indexStart = field(2)
+	meta.indexLen = field(1)
+	if meta.version < 1 || tailLen < 8*7 {
+		// 旧版本文件没有范围删除标记区
+		return
+	}
+	meta.rangeStart = field(7)
+	meta.rangeLen = field(6)
 }
 
 // 加载稀疏索引区到内存
 func (ss *SSTable) loadSparseIndex() {
 	// 加载稀疏索引区
 	bytes := make([]byte, ss.tableMetaInfo.indexLen)
-	if _, err := ss.f.Seek(ss.tableMetaInfo.indexStart, 0); err != nil {
-		log.Println("打开文件失败", ss.filePath)
-		panic(err)
-	}
-	if _, err := ss.f.Read(bytes); err != nil {
+	if err := readAt(ss.f, bytes, ss.tableMetaInfo.indexStart); err != nil {
 		log.Println("打开文件失败", ss.filePath)
 		panic(err)
 	}
@@ -119,7 +173,6 @@ func (ss *SSTable) loadSparseIndex() {
 		log.Println("打开文件失败", ss.filePath)
 		panic(err)
 	}
-	_, _ = ss.f.Seek(0, 0)
 
 	// 先排序
 	keys := make([]string, 0, len(ss.sparseIndex))
@@ -130,12 +183,122 @@ func (ss *SSTable) loadSparseIndex() {
 	ss.sortIndex = keys
 }
 
+// 加载范围删除标记区到内存
+func (ss *SSTable) loadRangeDels() {
+	if ss.tableMetaInfo.rangeLen == 0 {
+		return
+	}
+	bytes := make([]byte, ss.tableMetaInfo.rangeLen)
+	if err := readAt(ss.f, bytes, ss.tableMetaInfo.rangeStart); err != nil {
+		log.Println("打开文件失败", ss.filePath)
+		panic(err)
+	}
+	if err := json.Unmarshal(bytes, &ss.rangeDels); err != nil {
+		log.Println("打开文件失败", ss.filePath)
+		panic(err)
+	}
+}
+
+// 以只读的形式打开文件,mmap 为 true 时将数据区映射到内存
+func (ss *SSTable) open(mmap bool) {
+	var err error
+	ss.f, err = ss.fs.Open(ss.filePath)
+	if err != nil {
+		log.Println("打开文件失败", ss.filePath)
+		panic(err)
+	}
+	if mmap {
+		ss.mmap()
+	}
+}
+
+// 将数据区映射到内存,失败时记录日志并继续使用 ReadAt
+func (ss *SSTable) mmap() {
+	if ss.tableMetaInfo.dataLen == 0 {
+		return
+	}
+	data, err := mmapFile(ss.f, ss.tableMetaInfo.dataLen)
+	if err != nil {
+		log.Println("映射文件失败", ss.filePath, err)
+		return
+	}
+	ss.data = data
+}
+
+// 解除映射并关闭文件,同时移除其在块缓存中的数据块,调用方需保证没有并发的读取
+func (ss *SSTable) close() error {
+	ss.blocks.EvictFile(ss.id)
+	if ss.data != nil {
+		if err := munmapFile(ss.data); err != nil {
+			return err
+		}
+		ss.data = nil
+	}
+	if ss.f == nil {
+		return nil
+	}
+	err := ss.f.Close()
+	ss.f = nil
+	return err
+}
+
+// RawValue 获取 key 在数据区中编码后的内容,删除标记或不存在时返回 false,
+// 数据区已映射到内存时直接返回映射的切片而不复制,该切片在 SSTable 被关闭或压缩删除后失效,调用方不应修改
+func (ss *SSTable) RawValue(key string) ([]byte, bool) {
+	i := sort.SearchStrings(ss.sortIndex, key)
+	if i == len(ss.sortIndex) || ss.sortIndex[i] != key {
+		return nil, false
+	}
+	position := ss.sparseIndex[key]
+	if position.Deleted {
+		return nil, false
+	}
+	return ss.raw(position)
+}
+
+// 获取指定位置编码后的内容,已映射时不复制
+func (ss *SSTable) raw(position Position) ([]byte, bool) {
+	if ss.data != nil {
+		if position.Start+position.Len > int64(len(ss.data)) {
+			log.Println("元素超出数据区", ss.filePath)
+			return nil, false
+		}
+		return ss.data[position.Start : position.Start+position.Len : position.Start+position.Len], true
+	}
+	bytes := make([]byte, position.Len)
+	if err := readAt(ss.f, bytes, position.Start); err != nil {
+		log.Println(err)
+		return nil, false
+	}
+	return bytes, true
+}
+
+// 从文件的 off 处读满 buf,ReadAt 不改变文件偏移,可供多个协程同时读取同一文件,
+// 读到文件末尾仍未读满时返回 io.ErrUnexpectedEOF
+func readAt(f io.ReaderAt, buf []byte, off int64) error {
+	for read := 0; read < len(buf); {
+		n, err := f.ReadAt(buf[read:], off+int64(read))
+		read += n
+		if read == len(buf) {
+			return nil
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Get 查找元素，
 // 先使用二分查找法从内存中的 keys 列表查找 Key，如果存在，找到 Position ，再通过从数据区加载
-func (ss *SSTable) Get(key string) (any, bool) {
-	ss.Lock()
-	defer ss.Unlock()
-
+// 找到的元素可能是删除标记,key 未被该表记录但处于该表的范围删除标记内时同样返回删除标记
+func (ss *SSTable) Get(key string) (*kv.Value, bool) {
+	if !ss.mayContain(key) {
+		return nil, false
+	}
 	// 元素定位
 	var position = Position{
 		Start: -1,
@@ -151,7 +314,7 @@ func (ss *SSTable) Get(key string) (any, bool) {
 			position = ss.sparseIndex[key]
 			// 如果元素已被删除，则返回
 			if position.Deleted {
-				return nil, true
+				return kv.NewValue(key, nil, true), true
 			}
 			break
 		} else if ss.sortIndex[mid] < key {
@@ -162,18 +325,70 @@ func (ss *SSTable) Get(key string) (any, bool) {
 	}
 
 	if position.Start == -1 {
+		if kv.Covered(ss.rangeDels, key) {
+			return kv.NewValue(key, nil, true), true
+		}
 		return nil, false
 	}
+	return ss.read(position)
+}
+
+// MultiGet 批量查找元素,keys 需已升序排列,
+// 只需将 keys 与内存中有序的 key 列表归并一遍,再按文件顺序从数据区加载
+// 返回找到的元素,其中可能包含删除标记
+func (ss *SSTable) MultiGet(keys []string) map[string]*kv.Value {
+	values := make(map[string]*kv.Value)
+	i, j := 0, 0
+	for i < len(keys) {
+		key := keys[i]
+		for j < len(ss.sortIndex) && ss.sortIndex[j] < key {
+			j++
+		}
+		if j < len(ss.sortIndex) && ss.sortIndex[j] == key {
+			position := ss.sparseIndex[key]
+			if position.Deleted {
+				values[key] = kv.NewValue(key, nil, true)
+			} else if value, ok := ss.read(position); ok {
+				values[key] = value
+			}
+		} else if kv.Covered(ss.rangeDels, key) {
+			values[key] = kv.NewValue(key, nil, true)
+		}
+		i++
+	}
+	return values
+}
 
+// Scan 按 key 升序获取 [start, end) 内的所有元素,end 为空时表示不设上限,其中可能包含删除标记
+func (ss *SSTable) Scan(start, end string) []*kv.Value {
+	values := make([]*kv.Value, 0)
+	for i := sort.SearchStrings(ss.sortIndex, start); i < len(ss.sortIndex); i++ {
+		key := ss.sortIndex[i]
+		if end != "" && key >= end {
+			break
+		}
+		position := ss.sparseIndex[key]
+		if position.Deleted {
+			values = append(values, kv.NewValue(key, nil, true))
+		} else if value, ok := ss.read(position); ok {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// 从数据区加载指定位置的元素,先从块缓存中查找
+func (ss *SSTable) read(position Position) (*kv.Value, bool) {
+	key := cache.BlockKey{File: ss.id, Offset: position.Start}
+	if h, ok := ss.blocks.Lookup(key, ss.level); ok {
+		value := *h.Value()
+		h.Release()
+		return &value, true
+	}
 	// Todo：如果读取失败，需要增加错误处理过程
 	// 从磁盘文件中查找
-	bytes := make([]byte, position.Len)
-	if _, err := ss.f.Seek(position.Start, 0); err != nil {
-		log.Println(err)
-		return nil, false
-	}
-	if _, err := ss.f.Read(bytes); err != nil {
-		log.Println(err)
+	bytes, ok := ss.raw(position)
+	if !ok {
 		return nil, false
 	}
 
@@ -182,5 +397,9 @@ func (ss *SSTable) Get(key string) (any, bool) {
 		log.Println(err)
 		return nil, false
 	}
-	return value.Value, true
+	if ss.blocks != nil {
+		cached := value
+		ss.blocks.Insert(key, ss.level, &cached, position.Len).Release()
+	}
+	return &value, true
 }
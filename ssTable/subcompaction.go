@@ -0,0 +1,134 @@
+package ssTable
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+/*
+子压缩:
+输入较大时按 key 范围将一次压缩拆分为多个子压缩,每个子压缩只读取并合并各区块中范围内的元素,
+由多个协程并发执行,各自边合并边写入互不重叠的输出区块,全部完成后按索引依次挂入输出层,
+各子压缩的范围互不重叠且覆盖全部 key,故合并结果与不拆分时相同,只是输出区块的切分位置可能不同
+*/
+
+// SetSubcompactions 设置单次压缩最多拆分出的子压缩数量,即并发执行的协程数,小于等于 1 时不拆分
+func (tree *TableTree) SetSubcompactions(n int) {
+	if n < 1 {
+		n = 1
+	}
+	tree.Lock()
+	defer tree.Unlock()
+	tree.subcompactions = n
+}
+
+// 区块中 key 在 [start, end) 内的所有 key,按升序排列,end 为空时表示不设上限
+func (ss *SSTable) keysIn(start, end string) []string {
+	lo := sort.SearchStrings(ss.sortIndex, start)
+	hi := len(ss.sortIndex)
+	if end != "" {
+		hi = sort.SearchStrings(ss.sortIndex, end)
+	}
+	if lo >= hi {
+		return nil
+	}
+	return ss.sortIndex[lo:hi]
+}
+
+// 按输入的 key 分布将 key 空间切分为至多 workers 个范围,返回各范围的边界,
+// 首尾均为空字符串,即第一个范围不设下限、最后一个范围不设上限,输入不足两个目标文件大小时不切分
+func (tree *TableTree) splitBounds(tables []*SSTable, workers int) []string {
+	total, count := int64(0), 0
+	for _, table := range tables {
+		total += table.size()
+		count += len(table.sortIndex)
+	}
+	n := int(total / tree.fileTarget())
+	if n > workers {
+		n = workers
+	}
+	if n < 2 || count < n {
+		return []string{"", ""}
+	}
+	// 从每个区块中等距抽取 key 作为样本
+	step := count/(n*16) + 1
+	samples := make([]string, 0, count/step+len(tables))
+	for _, table := range tables {
+		for i := 0; i < len(table.sortIndex); i += step {
+			samples = append(samples, table.sortIndex[i])
+		}
+	}
+	sort.Strings(samples)
+	bounds := []string{""}
+	for i := 1; i < n; i++ {
+		key := samples[i*len(samples)/n]
+		// 边界需严格递增,且第一个边界不能为空字符串
+		if key > bounds[len(bounds)-1] {
+			bounds = append(bounds, key)
+		}
+	}
+	return append(bounds, "")
+}
+
+// 按边界并发执行各子压缩,同时执行的数量不超过 workers,返回按 key 顺序排列的结果
+func (tree *TableTree) runSpans(ctx context.Context, job *mergeJob, bounds []string, workers int) ([]*span, error) {
+	spans := make([]*span, len(bounds)-1)
+	for i := range spans {
+		spans[i] = &span{start: bounds[i], end: bounds[i+1]}
+	}
+	if len(spans) == 1 {
+		return spans, job.run(ctx, spans[0])
+	}
+	errs := make([]error, len(spans))
+	parallel(len(spans), workers, func(i int) {
+		errs[i] = job.run(ctx, spans[i])
+	})
+	for _, err := range errs {
+		if err != nil {
+			// 已完成的子压缩的输出尚未挂入区块树,需删除,否则重新打开后会与未压缩的输入一同载入
+			for _, sp := range spans {
+				sp.discard(tree)
+			}
+			return nil, err
+		}
+	}
+	return spans, nil
+}
+
+// 关闭并删除子压缩已写入的输出区块
+func (sp *span) discard(tree *TableTree) {
+	for _, node := range sp.outputs {
+		tree.remove(node.table)
+	}
+	sp.outputs = nil
+}
+
+// 以至多 workers 个协程执行 fn(0) 到 fn(n-1),全部完成后返回
+func parallel(n, workers int, fn func(i int)) {
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		for i := 0; i < n; i++ {
+			fn(i)
+		}
+		return
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
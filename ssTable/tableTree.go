@@ -1,11 +1,14 @@
 package ssTable
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"github.com/hlccd/hlsm/cache"
 	"github.com/hlccd/hlsm/kv"
+	"github.com/hlccd/hlsm/rateLimiter"
+	"github.com/hlccd/hlsm/vfs"
 	"log"
-	"os"
 	"path"
 	"path/filepath"
 	"sort"
@@ -23,12 +26,26 @@ const (
 )
 
 type TableTree struct {
-	dir          string
-	cap          int64
-	levelSize    int
-	levelMaxSize []int
-	levels       []*Table
-	topBlockNum  int
+	dir            string
+	cap            int64
+	capMax         int64 // 顶级区块的目标大小
+	levelSize      int
+	levels         []*Table
+	compactPointer []string // 每层上次压缩到的位置,下次从其后的区块开始选取,使各区块轮流被压缩
+	topBlockNum    int
+	topBlockIDs    map[int]uint64       // 顶级区块每次查找都重新打开,以固定的编号共享块缓存
+	topBlockRanges map[int]keyRange     // 已知的顶级区块的 key 范围,用于回收删除标记
+	blocks         *cache.BlockCache    // 共享的块缓存,未启用时为 nil
+	mmap           bool                 // 非顶级区块是否以内存映射的方式读取
+	policy         CompactionPolicy     // 压缩策略
+	filter         CompactionFilter     // 压缩过滤器,未设置时为 nil
+	written        WriteStats           // 写入硬盘的字节数
+	compactStats   CompactionStats      // 压缩的统计
+	subcompactions int                  // 单次压缩最多拆分出的子压缩数量
+	limiter        *rateLimiter.Limiter // 落盘及压缩读写硬盘的限速器,未设置时为 nil
+	closed         bool                 // 是否已关闭,关闭后不再压缩
+	fs             vfs.FS               // 区块文件所在的文件系统
+	compactLock    sync.Mutex           // 保证同时只执行一次压缩
 	sync.RWMutex
 }
 
@@ -37,19 +54,98 @@ func NewTableTree(dir string, capMin, capMax int64) *TableTree {
 	for c := capMin; c <= capMax; c *= capDisparity {
 		levelSize++
 	}
-	levelMaxSize := make([]int, levelSize)
-	levelMaxSize[0] = 10
-	for i := 1; i < levelSize; i++ {
-		levelMaxSize[i] = levelMaxSize[i-1] * 10
-	}
 	return &TableTree{
-		dir:          dir,
-		cap:          capMin,
-		levelSize:    levelSize,
-		levelMaxSize: levelMaxSize,
-		levels:       make([]*Table, levelSize),
-		topBlockNum:  0,
+		dir:            dir,
+		cap:            capMin,
+		capMax:         capMax,
+		levelSize:      levelSize,
+		levels:         make([]*Table, levelSize),
+		compactPointer: make([]string, levelSize),
+		topBlockNum:    0,
+		topBlockIDs:    make(map[int]uint64),
+		topBlockRanges: make(map[int]keyRange),
+		policy:         NewLeveledPolicy(),
+		subcompactions: 1,
+		fs:             vfs.OS(),
+	}
+}
+
+// WriteStats 区块树写入硬盘的字节数
+type WriteStats struct {
+	Flushed   int64 // 缓存区落盘写入的字节数
+	Compacted int64 // 压缩写入的字节数,包括顶级区块,移动文件不计入
+}
+
+// WriteAmplification 写放大,即总写入量与落盘写入量之比,尚未落盘时为 0
+func (s WriteStats) WriteAmplification() float64 {
+	if s.Flushed == 0 {
+		return 0
+	}
+	return float64(s.Flushed+s.Compacted) / float64(s.Flushed)
+}
+
+// WriteStats 获取区块树写入硬盘的字节数
+func (tree *TableTree) WriteStats() WriteStats {
+	tree.RLock()
+	defer tree.RUnlock()
+	return tree.written
+}
+
+// SetCompactionPolicy 设置压缩策略,只能为内置的策略之一,为 nil 时使用分层压缩
+func (tree *TableTree) SetCompactionPolicy(policy CompactionPolicy) {
+	if policy == nil {
+		policy = NewLeveledPolicy()
 	}
+	tree.Lock()
+	defer tree.Unlock()
+	tree.policy = policy
+}
+
+// SetRateLimiter 设置落盘及压缩读写硬盘的限速器,为 nil 时不限速
+func (tree *TableTree) SetRateLimiter(limiter *rateLimiter.Limiter) {
+	tree.Lock()
+	defer tree.Unlock()
+	tree.limiter = limiter
+}
+
+// SetBlockCache 设置共享的块缓存,需在加载 SSTable 前调用
+func (tree *TableTree) SetBlockCache(blocks *cache.BlockCache) {
+	tree.Lock()
+	defer tree.Unlock()
+	tree.blocks = blocks
+}
+
+// SetMmap 设置非顶级区块是否以内存映射的方式读取,需在加载 SSTable 前调用,
+// 顶级区块每次查找都重新打开,不做映射
+func (tree *TableTree) SetMmap(enabled bool) {
+	tree.Lock()
+	defer tree.Unlock()
+	tree.mmap = enabled
+}
+
+// SetFS 设置区块文件所在的文件系统,需在加载 SSTable 前调用
+func (tree *TableTree) SetFS(fs vfs.FS) {
+	tree.Lock()
+	defer tree.Unlock()
+	tree.fs = fs
+}
+
+// 打开指定编号的顶级区块,用完后需关闭文件,顶级区块在统计中视为第 levelSize 层
+func (tree *TableTree) openTopBlock(dir string, index int) *SSTable {
+	p := dir + "/" + topBlockName(index)
+	table := NewSSTableFormLoad(tree.fs, p)
+	tree.Lock()
+	id, ok := tree.topBlockIDs[index]
+	if !ok {
+		id = table.id
+		tree.topBlockIDs[index] = id
+	}
+	table.id = id
+	table.level = tree.levelSize
+	table.blocks = tree.blocks
+	tree.topBlockRanges[index] = table.keyRange()
+	tree.Unlock()
+	return table
 }
 
 func (tree *TableTree) LoadDB(name string) {
@@ -76,7 +172,12 @@ func (tree *TableTree) LoadDbFile(path string) {
 	if err != nil {
 		return
 	}
-	table := NewSSTableFormLoad(path)
+	table := NewSSTableFormLoad(tree.fs, path)
+	table.level = level
+	table.blocks = tree.blocks
+	if tree.mmap {
+		table.mmap()
+	}
 	newNode := NewTable(index, table)
 
 	currentNode := tree.levels[level]
@@ -103,7 +204,14 @@ func (tree *TableTree) LoadDbFile(path string) {
 	}
 }
 
-func (tree *TableTree) Get(key string) (any, bool) {
+// Get 依次从各层查找 key,找到的元素可能是删除标记
+func (tree *TableTree) Get(key string) (*kv.Value, bool) {
+	value, ok, _ := tree.GetCtx(context.Background(), key)
+	return value, ok
+}
+
+// GetCtx 与 Get 相同,但在查找每个 SSTable 前检查 ctx
+func (tree *TableTree) GetCtx(ctx context.Context, key string) (*kv.Value, bool, error) {
 	tree.RLock()
 	defer tree.RUnlock()
 
@@ -117,36 +225,200 @@ func (tree *TableTree) Get(key string) (any, bool) {
 		}
 		// 查找的时候要从最后一个 SSTable 开始查找
 		for i := len(tables) - 1; i >= 0; i-- {
+			if err := ctx.Err(); err != nil {
+				return nil, false, err
+			}
 			if value, ok := tables[i].Get(key); ok {
-				return value, true
+				return value, true, nil
 			}
 		}
 	}
-	return nil, false
+	return nil, false, nil
+}
+
+// GetFromStorage 从新到旧依次从顶级区块中查找 key,找到的元素可能是删除标记
+func (tree *TableTree) GetFromStorage(key string) (*kv.Value, bool) {
+	value, ok, _ := tree.GetFromStorageCtx(context.Background(), key)
+	return value, ok
 }
 
-func (tree *TableTree) GetFromStorage(key string) (any, bool) {
+// GetFromStorageCtx 与 GetFromStorage 相同,但在打开每个顶级区块前检查 ctx
+func (tree *TableTree) GetFromStorageCtx(ctx context.Context, key string) (*kv.Value, bool, error) {
 	tree.RLock()
 	num := tree.topBlockNum
 	dir := tree.dir
 	tree.RUnlock()
 	for index := num; index > 0; index-- {
+		if err := ctx.Err(); err != nil {
+			return nil, false, err
+		}
 		log.Printf("正在从顶级区块 %d 中查找", index)
-		p := dir + "/" + topBlockPre + "." + strconv.Itoa(index) + "." + dbSuffix
-		table := NewSSTableFormLoad(p)
-		if value, ok := table.Get(key); ok {
-			return value, true
+		table := tree.openTopBlock(dir, index)
+		value, ok := table.Get(key)
+		_ = table.f.Close()
+		if ok {
+			return value, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// ScanCtx 获取 [start, end) 内未被删除的元素并按 key 升序排列,end 为空时表示不设上限,
+// 由新到旧依次扫描各 SSTable 和顶级区块,在扫描每个区块前检查 ctx
+func (tree *TableTree) ScanCtx(ctx context.Context, start, end string) ([]*kv.Value, error) {
+	// 已确定的元素,包括删除标记
+	values := make(map[string]*kv.Value)
+	// 已扫描过的区块中的范围删除标记,作用于之后扫描的更旧区块
+	ranges := make([]kv.RangeTombstone, 0)
+	scan := func(table *SSTable) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		for _, value := range table.Scan(start, end) {
+			if _, ok := values[value.Key]; ok || kv.Covered(ranges, value.Key) {
+				continue
+			}
+			values[value.Key] = value
+		}
+		ranges = append(ranges, table.rangeDels...)
+		return nil
+	}
+
+	tree.RLock()
+	for _, node := range tree.levels {
+		tables := make([]*SSTable, 0)
+		for node != nil {
+			tables = append(tables, node.table)
+			node = node.next
+		}
+		for i := len(tables) - 1; i >= 0; i-- {
+			if err := scan(tables[i]); err != nil {
+				tree.RUnlock()
+				return nil, err
+			}
+		}
+	}
+	num := tree.topBlockNum
+	dir := tree.dir
+	tree.RUnlock()
+
+	for index := num; index > 0; index-- {
+		table := tree.openTopBlock(dir, index)
+		err := scan(table)
+		_ = table.f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result := make([]*kv.Value, 0, len(values))
+	for _, value := range values {
+		if !value.Deleted {
+			result = append(result, value)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result, nil
+}
+
+// MultiGet 批量查找,keys 需已升序排列,每个 SSTable 和顶级区块只会被扫描一次,
+// 返回找到的元素,其中可能包含删除标记
+func (tree *TableTree) MultiGet(keys []string) map[string]*kv.Value {
+	values := make(map[string]*kv.Value, len(keys))
+	// 尚未找到的 key
+	pending := keys
+	probe := func(table *SSTable) {
+		if len(pending) == 0 {
+			return
+		}
+		found := table.MultiGet(pending)
+		if len(found) == 0 {
+			return
+		}
+		rest := make([]string, 0, len(pending)-len(found))
+		for _, key := range pending {
+			if value, ok := found[key]; ok {
+				values[key] = value
+			} else {
+				rest = append(rest, key)
+			}
+		}
+		pending = rest
+	}
+
+	tree.RLock()
+	for _, node := range tree.levels {
+		tables := make([]*SSTable, 0)
+		for node != nil {
+			tables = append(tables, node.table)
+			node = node.next
+		}
+		// 从最新的 SSTable 开始查找
+		for i := len(tables) - 1; i >= 0; i-- {
+			probe(tables[i])
 		}
 	}
-	return nil, false
+	num := tree.topBlockNum
+	dir := tree.dir
+	tree.RUnlock()
+
+	for index := num; index > 0 && len(pending) > 0; index-- {
+		table := tree.openTopBlock(dir, index)
+		probe(table)
+		_ = table.f.Close()
+	}
+	return values
 }
 
 // Insert 创建新的 SSTable，插入到合适的层
-func (tree *TableTree) Insert(values []*kv.Value, level int) *SSTable {
+func (tree *TableTree) Insert(values []*kv.Value, ranges []kv.RangeTombstone, level int) *SSTable {
+	// 区块写入并打开后才挂入区块树,并发的查找不会读到未写完的文件
+	node := tree.create(values, ranges, level, tree.nextIndex(level))
+	tree.Lock()
+	tree.appendNode(node, level)
+	tree.written.Flushed += node.table.size()
+	tree.Unlock()
+	return node.table
+}
+
+// 创建指定层和索引的 SSTable 文件并打开,尚未挂入区块树
+func (tree *TableTree) create(values []*kv.Value, ranges []kv.RangeTombstone, level, index int) *Table {
+	ss, dataArea, indexArea, rangeArea := newTableData(values, ranges)
+	ss.level = level
+	ss.blocks = tree.blocks
+	ss.fs = tree.fs
+
+	log.Printf("创建了一个新区块,level: %d ,index: %d\r\n", level, index)
+	ss.filePath = tree.tablePath(level, index)
+
+	// 持久化保存,写入前按限速等待
+	tree.limiter.Wait(ss.size())
+	writeDataToFile(tree.fs, ss.filePath, dataArea, indexArea, rangeArea, ss.tableMetaInfo)
+	// 以只读的形式打开文件
+	ss.open(tree.mmap)
+	return NewTable(index, ss)
+}
+
+func (tree *TableTree) tablePath(level, index int) string {
+	return tree.dir + "/" + strconv.Itoa(level) + "." + strconv.Itoa(index) + "." + dbSuffix
+}
+
+func (tree *TableTree) topBlockPath(index int) string {
+	return tree.dir + "/" + topBlockName(index)
+}
+
+func topBlockName(index int) string {
+	return topBlockPre + "." + strconv.Itoa(index) + "." + dbSuffix
+}
+
+// 生成 SSTable 的数据区、稀疏索引区和范围删除标记区
+func newTableData(values []*kv.Value, ranges []kv.RangeTombstone) (ss *SSTable, dataArea, indexArea, rangeArea []byte) {
 	// 生成数据区
 	keys := make([]string, 0, len(values))
 	positions := make(map[string]Position)
-	dataArea := make([]byte, 0)
+	dataArea = make([]byte, 0)
 	for _, value := range values {
 		data, err := value.Encode()
 		if err != nil {
@@ -171,95 +443,105 @@ func (tree *TableTree) Insert(values []*kv.Value, level int) *SSTable {
 		log.Fatal("ssTable 文件创建失败,", err)
 	}
 
-	// 生成 MetaInfo
-	meta := NewMetaInfo(int64(len(dataArea)), int64(len(dataArea)), int64(len(indexArea)))
-	ss := NewSSTable(meta, positions, keys)
-
-	index := tree.insert(ss, level)
-
-	log.Printf("创建了一个新区块,level: %d ,index: %d\r\n", level, index)
-	ss.filePath = tree.dir + "/" + strconv.Itoa(level) + "." + strconv.Itoa(index) + "." + dbSuffix
-
-	// 持久化保存
-	writeDataToFile(ss.filePath, dataArea, indexArea, meta)
-	// 以只读的形式打开文件
-	ss.f, err = os.OpenFile(ss.filePath, os.O_RDONLY, 0666)
-	if err != nil {
-		log.Println("打开文件失败", ss.filePath)
-		panic(err)
+	// 生成范围删除标记区
+	ranges = kv.MergeRanges(ranges)
+	if len(ranges) > 0 {
+		rangeArea, err = json.Marshal(ranges)
+		if err != nil {
+			log.Fatal("ssTable 文件创建失败,", err)
+		}
 	}
 
-	return ss
+	// 生成 MetaInfo
+	meta := NewMetaInfo(int64(len(dataArea)), int64(len(dataArea)), int64(len(indexArea)), int64(len(rangeArea)))
+	ss = NewSSTable(meta, positions, keys, ranges)
+	return ss, dataArea, indexArea, rangeArea
 }
 
-// 插入一个 SSTable 到指定层
-func (tree *TableTree) insert(table *SSTable, level int) (index int) {
-	tree.Lock()
-	defer tree.Unlock()
+// 指定层下一个 SSTable 的索引,即最后一个的索引加一
+func (tree *TableTree) nextIndex(level int) int {
+	tree.RLock()
+	defer tree.RUnlock()
+	return tree.levelNextIndex(level)
+}
 
-	// 每次插入的，都出现在最后面
+// 与 nextIndex 相同,调用方需持有锁
+func (tree *TableTree) levelNextIndex(level int) int {
 	node := tree.levels[level]
-	newNode := &Table{
-		table: table,
-		next:  nil,
-		index: 0,
+	if node == nil {
+		return 0
+	}
+	for node.next != nil {
+		node = node.next
 	}
+	return node.index + 1
+}
 
+// 将节点追加到指定层的末尾,节点的索引需大于该层已有的节点,调用方需持有锁
+func (tree *TableTree) appendNode(newNode *Table, level int) {
+	newNode.next = nil
+	node := tree.levels[level]
 	if node == nil {
 		tree.levels[level] = newNode
-	} else {
-		for node != nil {
-			if node.next == nil {
-				newNode.index = node.index + 1
-				node.next = newNode
-				break
+		return
+	}
+	for node.next != nil {
+		node = node.next
+	}
+	node.next = newNode
+}
+
+// 从指定层中移除给定的区块,调用方需持有锁
+func (tree *TableTree) unlink(level int, tables []*SSTable) {
+	removed := make(map[*SSTable]bool, len(tables))
+	for _, table := range tables {
+		removed[table] = true
+	}
+	var head, tail *Table
+	for node := tree.levels[level]; node != nil; {
+		next := node.next
+		if !removed[node.table] {
+			node.next = nil
+			if tail == nil {
+				head = node
 			} else {
-				node = node.next
+				tail.next = node
 			}
+			tail = node
 		}
+		node = next
 	}
-	return newNode.index
+	tree.levels[level] = head
 }
 
-// Storage 生成顶级区块,持久化保存
-func (tree *TableTree) Storage(values []*kv.Value) {
-	// 生成数据区
-	keys := make([]string, 0, len(values))
-	positions := make(map[string]Position)
-	dataArea := make([]byte, 0)
-	for _, value := range values {
-		data, err := value.Encode()
-		if err != nil {
-			log.Println("key 插入失败:", value.Key, err)
-			continue
-		}
-		keys = append(keys, value.Key)
-		// 文件定位记录
-		positions[value.Key] = Position{
-			Start:   int64(len(dataArea)),
-			Len:     int64(len(data)),
-			Deleted: value.Deleted,
-		}
-		dataArea = append(dataArea, data...)
+// 获取指定层的所有区块,按索引由旧到新排列,调用方需持有锁
+func (tree *TableTree) tables(level int) []*SSTable {
+	tables := make([]*SSTable, 0)
+	for node := tree.levels[level]; node != nil; node = node.next {
+		tables = append(tables, node.table)
 	}
-	sort.Strings(keys)
+	return tables
+}
 
-	// 生成稀疏索引区
-	// map[string]Position to json
-	indexArea, err := json.Marshal(positions)
-	if err != nil {
-		log.Fatal("顶级 ssTable 文件创建失败,", err)
+// Close 关闭区块树中所有已打开的 SSTable 文件,并移除其在块缓存中的数据块
+// 等待正在执行的压缩完成,之后的压缩返回 ErrClosed
+func (tree *TableTree) Close() {
+	tree.compactLock.Lock()
+	defer tree.compactLock.Unlock()
+	tree.Lock()
+	defer tree.Unlock()
+	tree.closed = true
+	for _, id := range tree.topBlockIDs {
+		tree.blocks.EvictFile(id)
+	}
+	for _, node := range tree.levels {
+		for node != nil {
+			if node.table != nil {
+				_ = node.table.close()
+			}
+			node = node.next
+		}
 	}
-
-	// 生成 MetaInfo
-	meta := NewMetaInfo(int64(len(dataArea)), int64(len(dataArea)), int64(len(indexArea)))
-	ss := NewSSTable(meta, positions, keys)
-
-	log.Printf("创建了一个顶级区块: %d\n")
-	tree.topBlockNum++
-	ss.filePath = tree.dir + "/" + topBlockPre + "." + strconv.Itoa(tree.topBlockNum) + "." + dbSuffix
-	// 持久化保存
-	writeDataToFile(ss.filePath, dataArea, indexArea, meta)
 }
 
 // 获取该层有多少个 SSTable
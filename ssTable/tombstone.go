@@ -0,0 +1,102 @@
+package ssTable
+
+import "github.com/hlccd/hlsm/kv"
+
+/*
+删除标记回收:
+删除标记只用于遮蔽更旧区块中的同名元素,合并时若更旧的区块均不可能包含该 key,删除标记即可丢弃,
+更旧的区块包括不参与本次压缩的输入层及以下各层的区块,以及所有顶级区块,
+是否可能包含由区块的 key 范围判断,顶级区块的 key 范围在创建或打开后才可知,压缩前打开范围未知的顶级区块
+*/
+
+// keyRange 区块的 key 范围 [start, limit),bounded 为 false 时区块为空
+type keyRange struct {
+	start, limit string
+	bounded      bool
+}
+
+func (ss *SSTable) keyRange() keyRange {
+	return keyRange{start: ss.boundStart, limit: ss.boundLimit, bounded: ss.bounded}
+}
+
+// CompactionStats 压缩的统计
+type CompactionStats struct {
+	Compactions       int64 // 执行合并的次数,不包括直接移动或删除区块
+	TombstonesDropped int64 // 合并时丢弃的删除标记数量,包括范围删除标记
+}
+
+// CompactionStats 获取区块树的压缩统计
+func (tree *TableTree) CompactionStats() CompactionStats {
+	tree.RLock()
+	defer tree.RUnlock()
+	return tree.compactStats
+}
+
+// 打开 key 范围未知的顶级区块以获取其范围,只在数据库重新打开后的首次压缩时需要
+func (tree *TableTree) loadTopBlockRanges() {
+	tree.RLock()
+	unknown := make([]int, 0)
+	for index := 1; index <= tree.topBlockNum; index++ {
+		if _, ok := tree.topBlockRanges[index]; !ok {
+			unknown = append(unknown, index)
+		}
+	}
+	dir := tree.dir
+	tree.RUnlock()
+	for _, index := range unknown {
+		table := tree.openTopBlock(dir, index)
+		_ = table.f.Close()
+	}
+}
+
+// 比压缩输出更旧且不参与压缩的区块的 key 范围,存在 key 范围未知的顶级区块时 ok 为 false,调用方需持有锁
+func (tree *TableTree) olderRanges(c *compaction) (ranges []keyRange, ok bool) {
+	involved := make(map[*SSTable]bool, len(c.inputs)+len(c.overlaps))
+	for _, table := range c.inputs {
+		involved[table] = true
+	}
+	for _, table := range c.overlaps {
+		involved[table] = true
+	}
+	for level := c.level; level < tree.levelSize; level++ {
+		for node := tree.levels[level]; node != nil; node = node.next {
+			if !involved[node.table] && node.table.bounded {
+				ranges = append(ranges, node.table.keyRange())
+			}
+		}
+	}
+	for index := 1; index <= tree.topBlockNum; index++ {
+		r, known := tree.topBlockRanges[index]
+		if !known {
+			return nil, false
+		}
+		if r.bounded {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges, true
+}
+
+// 更旧的区块中是否可能存在 key 在 [start, limit) 内的元素
+func mayExist(older []keyRange, start, limit string) bool {
+	for _, r := range older {
+		if r.start < limit && start < r.limit {
+			return true
+		}
+	}
+	return false
+}
+
+// 丢弃更旧的区块均不可能包含其范围的范围删除标记,返回丢弃的数量
+func dropRanges(ranges []kv.RangeTombstone, older []keyRange) ([]kv.RangeTombstone, int) {
+	dropped := 0
+	kept := make([]kv.RangeTombstone, 0, len(ranges))
+	for _, r := range ranges {
+		if !mayExist(older, r.Start, r.End) {
+			dropped++
+			continue
+		}
+		kept = append(kept, r)
+	}
+	return kept, dropped
+}
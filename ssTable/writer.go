@@ -0,0 +1,132 @@
+package ssTable
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/hlccd/hlsm/kv"
+	"github.com/hlccd/hlsm/rateLimiter"
+	"github.com/hlccd/hlsm/vfs"
+	"io"
+	"log"
+)
+
+// 逐个写入元素的缓冲大小
+const writerBufferSize = 64 * 1024
+
+// tableWriter 按 key 升序逐个写入元素以生成 SSTable 文件,数据区直接写入文件,
+// 内存中只保留稀疏索引,写完后再依次写入稀疏索引区、范围删除标记区及元数据
+type tableWriter struct {
+	path      string
+	fs        vfs.FS
+	f         vfs.File
+	w         *bufio.Writer
+	limiter   *rateLimiter.Limiter // 写入前按限速等待,为 nil 时不限速
+	dataLen   int64                // 已写入的数据区长度
+	positions map[string]Position  // 稀疏索引
+	keys      []string             // 已写入的 key,按升序排列
+	size      int64                // 估算的文件大小,用于切分输出
+}
+
+func newTableWriter(fs vfs.FS, path string, limiter *rateLimiter.Limiter) *tableWriter {
+	f, err := fs.Create(path)
+	if err != nil {
+		log.Println("创建文件失败:", path)
+		panic(err)
+	}
+	return &tableWriter{
+		path:      path,
+		fs:        fs,
+		f:         f,
+		w:         bufio.NewWriterSize(f, writerBufferSize),
+		limiter:   limiter,
+		positions: make(map[string]Position),
+		keys:      make([]string, 0),
+	}
+}
+
+// 追加一个元素,key 需大于已写入的 key
+func (tw *tableWriter) add(value *kv.Value) {
+	data, err := value.Encode()
+	if err != nil {
+		log.Println("key 插入失败:", value.Key, err)
+		return
+	}
+	tw.limiter.Wait(int64(len(data)))
+	if _, err = tw.w.Write(data); err != nil {
+		log.Println("写入文件失败:", tw.path)
+		panic(err)
+	}
+	tw.positions[value.Key] = Position{
+		Start:   tw.dataLen,
+		Len:     int64(len(data)),
+		Deleted: value.Deleted,
+	}
+	tw.keys = append(tw.keys, value.Key)
+	tw.dataLen += int64(len(data))
+	tw.size += int64(len(data)) + int64(len(value.Key)) + positionSize
+}
+
+// 写入稀疏索引区、范围删除标记区及元数据并关闭文件,返回尚未打开文件的 SSTable
+func (tw *tableWriter) finish(ranges []kv.RangeTombstone) *SSTable {
+	indexArea, err := json.Marshal(tw.positions)
+	if err != nil {
+		log.Fatal("ssTable 文件创建失败,", err)
+	}
+	var rangeArea []byte
+	ranges = kv.MergeRanges(ranges)
+	if len(ranges) > 0 {
+		rangeArea, err = json.Marshal(ranges)
+		if err != nil {
+			log.Fatal("ssTable 文件创建失败,", err)
+		}
+	}
+	meta := NewMetaInfo(tw.dataLen, tw.dataLen, int64(len(indexArea)), int64(len(rangeArea)))
+	tw.limiter.Wait(int64(len(indexArea) + len(rangeArea)))
+	if _, err = tw.w.Write(indexArea); err != nil {
+		log.Println("写入文件失败:", tw.path)
+		panic(err)
+	}
+	if _, err = tw.w.Write(rangeArea); err != nil {
+		log.Println("写入文件失败:", tw.path)
+		panic(err)
+	}
+	if err = writeMeta(tw.w, meta); err != nil {
+		log.Println("写入文件失败:", tw.path)
+		panic(err)
+	}
+	if err = tw.w.Flush(); err != nil {
+		log.Println("写入文件失败:", tw.path)
+		panic(err)
+	}
+	if err = tw.f.Sync(); err != nil {
+		log.Println("写入文件失败:", tw.path)
+		panic(err)
+	}
+	if err = tw.f.Close(); err != nil {
+		log.Println("关闭文件失败:", tw.path)
+		panic(err)
+	}
+	ss := NewSSTable(meta, tw.positions, tw.keys, ranges)
+	ss.filePath = tw.path
+	ss.fs = tw.fs
+	return ss
+}
+
+// 放弃写入并删除文件
+func (tw *tableWriter) abort() {
+	_ = tw.f.Close()
+	_ = tw.fs.Remove(tw.path)
+}
+
+// 将元数据写入文件末尾
+func writeMeta(w io.Writer, meta MetaInfo) error {
+	// 注意，右侧必须能够识别字节长度的类型，不能使用 int 这种类型，只能使用 int32、int64 等
+	fields := []int64{meta.rangeStart, meta.rangeLen, meta.version, meta.dataStart, meta.dataLen, meta.indexStart, meta.indexLen}
+	for _, field := range fields {
+		if err := binary.Write(w, binary.LittleEndian, field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
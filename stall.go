@@ -0,0 +1,96 @@
+package hlsm
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// 后台压缩的状态
+type compactor struct {
+	pending int        // 已落盘但尚未被一轮完整的压缩覆盖的次数,用于衡量压缩落后的程度
+	running bool       // 后台压缩协程是否在运行
+	cond    *sync.Cond // 每轮压缩完成及后台协程退出时通知等待者
+	lock    sync.Mutex // 并发控制锁
+}
+
+// SetRateLimit 在运行时修改落盘及压缩读写硬盘的速率上限,rate 为 0 时不限速,burst 为 0 时为 rate
+func (lsm *HLsm) SetRateLimit(rate, burst int64) {
+	lsm.limiter.SetRate(rate, burst)
+}
+
+// RateLimit 当前落盘及压缩读写硬盘的速率上限及突发字节数
+func (lsm *HLsm) RateLimit() (rate, burst int64) {
+	return lsm.limiter.Rate()
+}
+
+// 缓存落盘后检查是否需要压缩,后台压缩时只通知后台协程,调用方需持有数据库锁
+func (lsm *HLsm) afterFlush(ctx context.Context) {
+	if !lsm.opts.BackgroundCompaction {
+		_ = lsm.compact(ctx)
+		return
+	}
+	lsm.bg.lock.Lock()
+	defer lsm.bg.lock.Unlock()
+	lsm.bg.pending++
+	if !lsm.bg.running {
+		lsm.bg.running = true
+		go lsm.compactLoop()
+	}
+}
+
+// 后台压缩协程,每轮压缩所有列族,直到没有新的落盘
+func (lsm *HLsm) compactLoop() {
+	for {
+		lsm.bg.lock.Lock()
+		n := lsm.bg.pending
+		if n == 0 {
+			lsm.bg.running = false
+			lsm.bg.cond.Broadcast()
+			lsm.bg.lock.Unlock()
+			return
+		}
+		lsm.bg.lock.Unlock()
+
+		lsm.RLock()
+		families := make([]*Family, 0, len(lsm.families))
+		for _, f := range lsm.families {
+			families = append(families, f)
+		}
+		lsm.RUnlock()
+		for _, f := range families {
+			// 列族被删除时区块树已关闭,返回的错误可以忽略
+			_ = f.tree.CompactionCtx(context.Background(), 0)
+		}
+
+		lsm.bg.lock.Lock()
+		lsm.bg.pending -= n
+		lsm.bg.cond.Broadcast()
+		lsm.bg.lock.Unlock()
+	}
+}
+
+// 等待后台压缩协程退出
+func (lsm *HLsm) waitCompaction() {
+	lsm.bg.lock.Lock()
+	defer lsm.bg.lock.Unlock()
+	for lsm.bg.running {
+		lsm.bg.cond.Wait()
+	}
+}
+
+// 后台压缩落后过多时限制写入,在获取数据库锁之前调用
+func (lsm *HLsm) stall() {
+	if !lsm.opts.BackgroundCompaction {
+		return
+	}
+	lsm.bg.lock.Lock()
+	for lsm.bg.pending >= lsm.opts.StopTrigger {
+		lsm.bg.cond.Wait()
+	}
+	slow := lsm.bg.pending >= lsm.opts.SlowdownTrigger
+	lsm.bg.lock.Unlock()
+	if slow {
+		time.Sleep(time.Millisecond)
+	}
+}
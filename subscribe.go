@@ -0,0 +1,233 @@
+package hlsm
+
+import (
+	"errors"
+	"github.com/hlccd/hlsm/kv"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Backpressure 订阅者消费过慢时的处理策略
+type Backpressure int
+
+const (
+	DropSubscriber Backpressure = iota // 取消该订阅,订阅者可根据最后收到的序号重新订阅,默认的策略
+	// BlockWriter 阻塞写入直到订阅者消费,保证不丢失变更,阻塞时持有数据库锁,所有写入均会等待,
+	// 订阅者在消费时写入该数据库会死锁
+	BlockWriter
+)
+
+var (
+	ErrSequenceUnavailable = errors.New("起始序号对应的预写日志已不再保留")
+	ErrSlowConsumer        = errors.New("订阅者消费过慢,订阅已取消")
+	ErrSubscriptionClosed  = errors.New("订阅已关闭")
+)
+
+// ChangeEvent 变更事件,End 不为空时表示删除 [Key, End) 的范围删除
+type ChangeEvent struct {
+	Family   string
+	Key      string
+	End      string
+	Value    any
+	Deleted  bool
+	Sequence uint64
+}
+
+// SubscribeOptions 订阅配置
+type SubscribeOptions struct {
+	Buffer       int          // 等待消费的变更数量上限,超过后按 Backpressure 处理
+	Backpressure Backpressure // 消费过慢时的处理策略,默认为 DropSubscriber
+}
+
+// Subscription 变更订阅,从 C 中按序号顺序接收变更事件,C 被关闭后可通过 Err 获取原因
+type Subscription struct {
+	C      <-chan ChangeEvent
+	ch     chan ChangeEvent
+	done   chan struct{}
+	prefix string
+	opts   SubscribeOptions
+	last   uint64        // 最后一个进入队列的事件序号,用于回放时去重
+	queue  []ChangeEvent // 等待发送的事件
+	closed bool          // 订阅是否已关闭
+	err    error         // 订阅关闭的原因
+	cond   *sync.Cond    // 队列变化时的通知
+	lock   sync.Mutex    // 并发控制锁
+	once   sync.Once     // 保证只关闭一次
+}
+
+// Subscribe 订阅 key 以 prefix 为前缀的变更,from 为 0 时只接收之后的变更,
+// 否则从序号 from 开始回放仍保留在预写日志中的变更
+func (lsm *HLsm) Subscribe(prefix string, from uint64) (*Subscription, error) {
+	return lsm.SubscribeWithOptions(prefix, from, SubscribeOptions{})
+}
+
+// SubscribeWithOptions 以给定配置订阅变更
+func (lsm *HLsm) SubscribeWithOptions(prefix string, from uint64, opts SubscribeOptions) (*Subscription, error) {
+	if opts.Buffer <= 0 {
+		opts.Buffer = 1024
+	}
+	// 持有写锁,保证回放与之后的实时变更之间没有遗漏
+	lsm.Lock()
+	defer lsm.Unlock()
+	sub := &Subscription{
+		ch:     make(chan ChangeEvent),
+		done:   make(chan struct{}),
+		prefix: prefix,
+		opts:   opts,
+		queue:  make([]ChangeEvent, 0),
+	}
+	sub.C = sub.ch
+	sub.cond = sync.NewCond(&sub.lock)
+	if from == 0 {
+		sub.last = lsm.seq
+	} else {
+		sub.last = from - 1
+		if from <= lsm.seq {
+			values := lsm.retainedLog()
+			oldest := lsm.seq + 1
+			for _, v := range values {
+				if v.Seq > 0 && v.Seq < oldest {
+					oldest = v.Seq
+				}
+			}
+			if from < oldest {
+				return nil, ErrSequenceUnavailable
+			}
+			// 回放的变更不受 Buffer 限制
+			sub.enqueue(values)
+		}
+	}
+	go sub.run()
+	lsm.subsLock.Lock()
+	lsm.subs = append(lsm.subs, sub)
+	lsm.subsLock.Unlock()
+	return sub, nil
+}
+
+// 读取保留的旧日志分段及当前预写日志中的所有记录,由旧到新排列,调用方需持有数据库锁
+func (lsm *HLsm) retainedLog() []*kv.Value {
+	values := make([]*kv.Value, 0)
+	for _, name := range lsm.walSegments() {
+		values = append(values, lsm.readLog(path.Join(lsm.dir, name))...)
+	}
+	return append(values, lsm.readLog(path.Join(lsm.dir, cacheName))...)
+}
+
+// 将新写入的记录通知给所有订阅,调用方需持有数据库锁
+func (lsm *HLsm) publish(values []*kv.Value) {
+	lsm.subsLock.Lock()
+	defer lsm.subsLock.Unlock()
+	alive := lsm.subs[:0]
+	for _, sub := range lsm.subs {
+		if sub.publish(values) {
+			alive = append(alive, sub)
+		}
+	}
+	for i := len(alive); i < len(lsm.subs); i++ {
+		lsm.subs[i] = nil
+	}
+	lsm.subs = alive
+}
+
+// 将记录转换为事件放入队列,跳过已放入过的序号和不匹配前缀的记录,调用方需持有订阅锁
+func (sub *Subscription) enqueue(values []*kv.Value) {
+	for _, v := range values {
+		if v.Seq <= sub.last {
+			continue
+		}
+		sub.last = v.Seq
+		if !sub.match(v) {
+			continue
+		}
+		family := v.Family
+		if family == "" {
+			family = DefaultFamily
+		}
+		sub.queue = append(sub.queue, ChangeEvent{
+			Family:   family,
+			Key:      v.Key,
+			End:      v.End,
+			Value:    v.Value,
+			Deleted:  v.Deleted,
+			Sequence: v.Seq,
+		})
+	}
+	sub.cond.Broadcast()
+}
+
+// 判断记录是否与订阅前缀匹配,范围删除与前缀范围有交集即视为匹配
+func (sub *Subscription) match(v *kv.Value) bool {
+	if strings.HasPrefix(v.Key, sub.prefix) {
+		return true
+	}
+	return v.End != "" && v.Key < sub.prefix && v.End > sub.prefix
+}
+
+// 向订阅发布记录,订阅已关闭时返回 false
+func (sub *Subscription) publish(values []*kv.Value) bool {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	for !sub.closed && len(sub.queue) >= sub.opts.Buffer {
+		if sub.opts.Backpressure == DropSubscriber {
+			sub.close(ErrSlowConsumer)
+			break
+		}
+		// 阻塞写入,等待订阅者消费
+		sub.cond.Wait()
+	}
+	if sub.closed {
+		return false
+	}
+	sub.enqueue(values)
+	return true
+}
+
+// 将队列中的事件依次发送给订阅者
+func (sub *Subscription) run() {
+	defer close(sub.ch)
+	for {
+		sub.lock.Lock()
+		for !sub.closed && len(sub.queue) == 0 {
+			sub.cond.Wait()
+		}
+		if sub.closed {
+			sub.lock.Unlock()
+			return
+		}
+		e := sub.queue[0]
+		sub.queue = sub.queue[1:]
+		sub.cond.Broadcast()
+		sub.lock.Unlock()
+		select {
+		case sub.ch <- e:
+		case <-sub.done:
+			return
+		}
+	}
+}
+
+// 关闭订阅,调用方需持有订阅锁
+func (sub *Subscription) close(err error) {
+	sub.once.Do(func() {
+		sub.closed = true
+		sub.err = err
+		sub.queue = nil
+		close(sub.done)
+		sub.cond.Broadcast()
+	})
+}
+
+// Close 取消订阅,C 随后会被关闭
+func (sub *Subscription) Close() {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	sub.close(ErrSubscriptionClosed)
+}
+
+// Err 订阅被关闭的原因,订阅仍有效时返回 nil
+func (sub *Subscription) Err() error {
+	sub.lock.Lock()
+	defer sub.lock.Unlock()
+	return sub.err
+}
@@ -0,0 +1,94 @@
+// 读缓存淘汰策略的命中率对比,回放 Zipfian 及夹杂大范围扫描的访问序列: go run ./test/cachebench
+package main
+
+import (
+	"fmt"
+	"github.com/hlccd/hlsm/cache"
+	"math/rand"
+	"strconv"
+)
+
+const (
+	keySpace = 100000  // 热点访问的 key 数量
+	accesses = 1000000 // 每个访问序列的访问次数
+	entries  = 2000    // 读缓存约可容纳的记录数
+)
+
+type readCache interface {
+	cache.Cache
+	cache.StatsReporter
+}
+
+var policies = []struct {
+	name string
+	new  func(cap int64) readCache
+}{
+	{"lru", func(cap int64) readCache { return cache.NewReadLRU(cap, nil) }},
+	{"tinylfu", func(cap int64) readCache { return cache.NewTinyLFU(cap, nil) }},
+	{"tinylfu-always", func(cap int64) readCache {
+		return cache.NewTinyLFUWithSizer(cap, cache.DeepSizer{}, cache.AlwaysAdmission, nil)
+	}},
+}
+
+func key(i int) string {
+	return "key" + strconv.Itoa(i)
+}
+
+// zipf 按 Zipf 分布访问 keySpace 个 key
+func zipf(r *rand.Rand) []string {
+	z := rand.NewZipf(r, 1.1, 1, keySpace-1)
+	trace := make([]string, accesses)
+	for i := range trace {
+		trace[i] = key(int(z.Uint64()))
+	}
+	return trace
+}
+
+// scan 在 Zipf 访问之间周期性地插入对冷 key 的顺序扫描,扫描到的 key 只会被访问一次
+func scan(r *rand.Rand) []string {
+	z := rand.NewZipf(r, 1.1, 1, keySpace-1)
+	trace := make([]string, 0, accesses)
+	cold := keySpace
+	for len(trace) < accesses {
+		for i := 0; i < 5000 && len(trace) < accesses; i++ {
+			trace = append(trace, key(int(z.Uint64())))
+		}
+		for i := 0; i < 5000 && len(trace) < accesses; i++ {
+			trace = append(trace, key(cold))
+			cold++
+		}
+	}
+	return trace
+}
+
+// 回放访问序列,未命中时从"磁盘"读取后放入读缓存
+func replay(c readCache, trace []string) cache.Stats {
+	for _, k := range trace {
+		if _, ok := c.Find(k); !ok {
+			c.Insert(k, k)
+		}
+	}
+	return c.Stats()
+}
+
+func main() {
+	// 以一条典型记录的估算大小换算读缓存容量
+	probe := cache.NewReadLRU(1<<40, nil)
+	probe.Insert(key(keySpace), key(keySpace))
+	capacity := probe.Size() * entries
+
+	traces := []struct {
+		name  string
+		trace []string
+	}{
+		{"zipf", zipf(rand.New(rand.NewSource(1)))},
+		{"scan", scan(rand.New(rand.NewSource(2)))},
+	}
+	fmt.Printf("capacity %d bytes (~%d entries)\n", capacity, entries)
+	for _, t := range traces {
+		for _, p := range policies {
+			s := replay(p.new(capacity), t.trace)
+			fmt.Printf("%-6s %-16s hit ratio %6.2f%%  evictions %d\n", t.name, p.name, s.HitRatio()*100, s.Evictions)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+// 文件系统故障下的检查: go run ./test/fault
+// 内存文件系统上的读写及重新打开与映射表一致;
+// 模拟崩溃后重新打开,数据库的内容与最近一次落盘时一致,预写日志未同步故其后的写入全部丢失;
+// 第 N 次写入失败后模拟崩溃并重新打开,数据库的内容与失败前最近一次落盘或正在进行的落盘时一致;
+// 缓存区将满时重新打开,回放日志时解码后的值估算更大,落盘后不丢失任何记录;
+// 删除列族在删除配置后崩溃,重新打开后该列族不再出现,之后创建的同名列族不含其数据
+package main
+
+import (
+	"fmt"
+	"github.com/hlccd/hlsm"
+	"github.com/hlccd/hlsm/vfs"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+)
+
+const (
+	dir  = "/db"
+	keys = 300
+)
+
+func main() {
+	log.SetOutput(ioutil.Discard)
+	failed := 0
+	for _, check := range []struct {
+		name string
+		fn   func(seed int64) error
+	}{
+		{"内存文件系统", memCheck},
+		{"模拟崩溃", crashCheck},
+		{"写入失败", failCheck},
+		{"日志回放", replayCheck},
+		{"删除列族", dropCheck},
+	} {
+		for seed := int64(1); seed <= 5; seed++ {
+			if err := check.fn(seed); err != nil {
+				fmt.Printf("%s seed=%d 失败: %v\n", check.name, seed, err)
+				failed++
+			}
+		}
+		fmt.Printf("%s 完成\n", check.name)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func options(fs vfs.FS) hlsm.Options {
+	// 缓存区足够大,只在调用 Compact 时落盘
+	return hlsm.Options{CapMin: 1 * hlsm.MB, CapMax: 16 * hlsm.MB, FS: fs}
+}
+
+func open(fs vfs.FS) *hlsm.HLsm {
+	if err := fs.MkdirAll(dir, 0777); err != nil {
+		panic(err)
+	}
+	return hlsm.NewHLsmWithOptions(dir, options(fs))
+}
+
+// 随机执行一次写入、删除或范围删除,并在映射表上执行相同的操作
+func step(lsm *hlsm.HLsm, model map[string]string, r *rand.Rand, i int) {
+	k := fmt.Sprintf("key%04d", r.Intn(keys))
+	switch x := r.Intn(10); {
+	case x < 7:
+		v := fmt.Sprintf("v%d", i)
+		model[k] = v
+		lsm.Insert(k, v)
+	case x < 9:
+		delete(model, k)
+		lsm.Erase(k)
+	default:
+		end := fmt.Sprintf("key%04d", r.Intn(keys))
+		for mk := range model {
+			if mk >= k && mk < end {
+				delete(model, mk)
+			}
+		}
+		lsm.DeleteRange(k, end)
+	}
+}
+
+func snapshot(model map[string]string) map[string]string {
+	s := make(map[string]string, len(model))
+	for k, v := range model {
+		s[k] = v
+	}
+	return s
+}
+
+// 比较数据库与映射表的内容
+func compare(lsm *hlsm.HLsm, model map[string]string) error {
+	values := lsm.Scan("", "")
+	if len(values) != len(model) {
+		return fmt.Errorf("得到 %d 个元素,应为 %d 个", len(values), len(model))
+	}
+	for _, v := range values {
+		if want, ok := model[v.Key]; !ok || fmt.Sprint(v.Value) != want {
+			return fmt.Errorf("%s=%v,应为 %q", v.Key, v.Value, want)
+		}
+		if got, ok := lsm.Get(v.Key); !ok || fmt.Sprint(got) != model[v.Key] {
+			return fmt.Errorf("Get(%s)=%v,应为 %q", v.Key, got, model[v.Key])
+		}
+	}
+	return nil
+}
+
+func memCheck(seed int64) error {
+	fs := vfs.NewMem()
+	lsm := open(fs)
+	r := rand.New(rand.NewSource(seed))
+	model := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		step(lsm, model, r, i)
+		if r.Intn(200) == 0 {
+			lsm.Compact()
+		}
+		if r.Intn(1000) == 0 {
+			if err := lsm.Close(); err != nil {
+				return err
+			}
+			lsm = open(fs)
+		}
+	}
+	if err := compare(lsm, model); err != nil {
+		return err
+	}
+	if err := lsm.Close(); err != nil {
+		return err
+	}
+	return compare(open(fs), model)
+}
+
+func crashCheck(seed int64) error {
+	fs := vfs.NewFault(vfs.NewMem())
+	lsm := open(fs)
+	r := rand.New(rand.NewSource(seed))
+	model := make(map[string]string)
+	durable := snapshot(model)
+	for round := 0; round < 5; round++ {
+		for i := r.Intn(2000); i >= 0; i-- {
+			step(lsm, model, r, i)
+			if r.Intn(300) == 0 {
+				lsm.Compact()
+				durable = snapshot(model)
+			}
+		}
+		if err := fs.Crash(); err != nil {
+			return err
+		}
+		lsm = open(fs)
+		if err := compare(lsm, durable); err != nil {
+			return fmt.Errorf("第 %d 次崩溃后: %v", round+1, err)
+		}
+		model = snapshot(durable)
+	}
+	return nil
+}
+
+func failCheck(seed int64) error {
+	r := rand.New(rand.NewSource(seed))
+	for round := 0; round < 10; round++ {
+		fs := vfs.NewFault(vfs.NewMem())
+		lsm := open(fs)
+		model := make(map[string]string)
+		durable := snapshot(model)
+		var pending map[string]string // 发生失败时正在落盘的内容
+		fs.FailWrite(int64(r.Intn(5000) + 1))
+		err := func() (err error) {
+			defer func() {
+				if p := recover(); p != nil {
+					err = fmt.Errorf("%v", p)
+				}
+			}()
+			for i := 0; i < 5000; i++ {
+				step(lsm, model, r, i)
+				if r.Intn(100) == 0 {
+					pending = snapshot(model)
+					lsm.Compact()
+					durable, pending = pending, nil
+				}
+			}
+			return nil
+		}()
+		if err == nil {
+			// 注入的失败位于所有写入之后
+			continue
+		}
+		if err.Error() != vfs.ErrInjected.Error() {
+			return fmt.Errorf("写入失败时的错误为 %v", err)
+		}
+		if err = fs.Crash(); err != nil {
+			return err
+		}
+		lsm = open(fs)
+		if err = compare(lsm, durable); err != nil && pending != nil {
+			err = compare(lsm, pending)
+		}
+		if err != nil {
+			return fmt.Errorf("第 %d 次写入失败后: %v", fs.Writes(), err)
+		}
+	}
+	return nil
+}
+
+type record struct {
+	ID   int
+	Name string
+	Tags []string
+}
+
+// 以结构体为值写入到缓存区将满而未落盘,日志中的值解码为映射表,重新打开后逐条回放不应丢失
+func replayCheck(seed int64) error {
+	opts := hlsm.Options{CapMin: 64 * hlsm.KB, CapMax: 1 * hlsm.MB}
+	// 先找出触发落盘的写入数量
+	opts.FS = vfs.NewMem()
+	if err := opts.FS.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	lsm := hlsm.NewHLsmWithOptions(dir, opts)
+	n := 0
+	for ; lsm.WriteStats().Flushed == 0; n++ {
+		lsm.Insert(fmt.Sprintf("key%05d", n), record{ID: n, Name: fmt.Sprint(seed), Tags: []string{"a", "b"}})
+	}
+	_ = lsm.Close()
+	opts.FS = vfs.NewMem()
+	if err := opts.FS.MkdirAll(dir, 0777); err != nil {
+		return err
+	}
+	lsm = hlsm.NewHLsmWithOptions(dir, opts)
+	for i := 0; i < n-1; i++ {
+		lsm.Insert(fmt.Sprintf("key%05d", i), record{ID: i, Name: fmt.Sprint(seed), Tags: []string{"a", "b"}})
+	}
+	if lsm.WriteStats().Flushed != 0 {
+		return fmt.Errorf("写入 %d 条记录时已落盘", n-1)
+	}
+	for round := 0; round < 2; round++ {
+		if err := lsm.Close(); err != nil {
+			return err
+		}
+		lsm = hlsm.NewHLsmWithOptions(dir, opts)
+		for i := 0; i < n-1; i++ {
+			if _, ok := lsm.Get(fmt.Sprintf("key%05d", i)); !ok {
+				return fmt.Errorf("第 %d 次重新打开后 key%05d 丢失", round+1, i)
+			}
+		}
+	}
+	return lsm.Close()
+}
+
+// 模拟删除列族时删除配置后、落盘及删除目录前崩溃
+func dropCheck(seed int64) error {
+	fs := vfs.NewMem()
+	lsm := open(fs)
+	f, err := lsm.CreateFamily("f", options(fs))
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 100; i++ {
+		f.Insert(fmt.Sprintf("key%04d", i), seed)
+	}
+	// 一部分已落盘,其余只在预写日志中
+	lsm.Compact()
+	for i := 100; i < 200; i++ {
+		f.Insert(fmt.Sprintf("key%04d", i), seed)
+	}
+	if err = lsm.Close(); err != nil {
+		return err
+	}
+	if err = fs.Remove(dir + "/f/family.hlsm"); err != nil {
+		return err
+	}
+	for round := 0; round < 2; round++ {
+		lsm = open(fs)
+		if _, ok := lsm.Family("f"); ok {
+			return fmt.Errorf("已删除的列族在重新打开后出现")
+		}
+		if f, err = lsm.CreateFamily("f", options(fs)); err != nil {
+			return fmt.Errorf("创建同名列族失败: %v", err)
+		}
+		if values := f.Scan("", ""); len(values) != 0 {
+			return fmt.Errorf("同名的新列族中有 %d 个已删除列族的元素", len(values))
+		}
+		if err = lsm.DropFamily("f"); err != nil {
+			return err
+		}
+		if err = lsm.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+// 纯内存模式的检查: go run ./test/inMemory
+// 相同的随机操作在硬盘模式与纯内存模式下得到相同的内容及相同的落盘、压缩统计,且内存模式生成了顶级区块;
+// 多个使用相同数据目录的内存数据库可并发使用而互不影响,且不会在硬盘上留下文件
+package main
+
+import (
+	"fmt"
+	"github.com/hlccd/hlsm"
+	"github.com/hlccd/hlsm/kv"
+	"github.com/hlccd/hlsm/vfs"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+const (
+	dir  = "hlsm-in-memory"
+	keys = 2000
+	ops  = 30000
+)
+
+func main() {
+	log.SetOutput(ioutil.Discard)
+	ok := true
+	if err := compareModes(); err != nil {
+		fmt.Println("与硬盘模式不一致:", err)
+		ok = false
+	} else {
+		fmt.Println("与硬盘模式一致")
+	}
+	if err := parallel(8); err != nil {
+		fmt.Println("并发使用失败:", err)
+		ok = false
+	} else {
+		fmt.Println("并发使用互不影响")
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		fmt.Println("硬盘上留下了数据目录")
+		ok = false
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+func options() hlsm.Options {
+	return hlsm.Options{CapMin: 2 * hlsm.KB, CapMax: 8 * hlsm.KB}
+}
+
+// 在默认列族及另一个列族上执行相同的随机操作
+func workload(lsm *hlsm.HLsm, seed int64) {
+	f, err := lsm.CreateFamily("other", options())
+	if err != nil {
+		panic(err)
+	}
+	r := rand.New(rand.NewSource(seed))
+	for i := 0; i < ops; i++ {
+		k := fmt.Sprintf("key%05d", r.Intn(keys))
+		switch x := r.Intn(20); {
+		case x < 14:
+			lsm.Insert(k, i)
+		case x < 17:
+			f.Insert(k, i)
+		case x < 19:
+			lsm.Erase(k)
+		default:
+			lsm.DeleteRange(k, fmt.Sprintf("key%05d", r.Intn(keys)))
+		}
+	}
+	lsm.Compact()
+}
+
+func contents(lsm *hlsm.HLsm) [2][]string {
+	f, _ := lsm.Family("other")
+	var c [2][]string
+	for i, values := range [][]*kv.Value{lsm.Scan("", ""), f.Scan("", "")} {
+		for _, v := range values {
+			c[i] = append(c[i], fmt.Sprintf("%s=%v", v.Key, v.Value))
+		}
+	}
+	return c
+}
+
+func compareModes() error {
+	disk, err := ioutil.TempDir("", "hlsm-disk")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(disk)
+	onDisk := hlsm.NewHLsmWithOptions(disk, options())
+	workload(onDisk, 1)
+
+	fs := vfs.NewMem()
+	opts := options()
+	opts.InMemory = true
+	opts.FS = fs
+	inMemory := hlsm.NewHLsmWithOptions(dir, opts)
+	workload(inMemory, 1)
+
+	if !reflect.DeepEqual(contents(onDisk), contents(inMemory)) {
+		return fmt.Errorf("内容不同")
+	}
+	if a, b := onDisk.WriteStats(), inMemory.WriteStats(); a != b {
+		return fmt.Errorf("写入统计 %+v 与 %+v 不同", a, b)
+	}
+	if a, b := onDisk.CompactionStats(), inMemory.CompactionStats(); a != b {
+		return fmt.Errorf("压缩统计 %+v 与 %+v 不同", a, b)
+	}
+	infos, err := fs.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	top := 0
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), "hlsm.") && strings.HasSuffix(info.Name(), ".db") {
+			top++
+		}
+	}
+	if top == 0 {
+		return fmt.Errorf("没有生成顶级区块")
+	}
+	// 关闭后在同一文件系统上重新打开,内容不变
+	want := contents(inMemory)
+	if err = inMemory.Close(); err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(contents(hlsm.NewHLsmWithOptions(dir, opts)), want) {
+		return fmt.Errorf("重新打开后内容不同")
+	}
+	_ = onDisk.Close()
+	return nil
+}
+
+// n 个内存数据库同时以相同的数据目录打开,各自写入不同的内容
+func parallel(n int) error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			opts := options()
+			opts.InMemory = true
+			lsm := hlsm.NewHLsmWithOptions(dir, opts)
+			for j := 0; j < 5000; j++ {
+				lsm.Insert(fmt.Sprintf("key%05d", j%keys), fmt.Sprintf("%d.%d", id, j))
+			}
+			lsm.Compact()
+			for j := 5000 - keys; j < 5000; j++ {
+				k := fmt.Sprintf("key%05d", j%keys)
+				if v, ok := lsm.Get(k); !ok || v != fmt.Sprintf("%d.%d", id, j) {
+					errs[id] = fmt.Errorf("数据库 %d 中 %s=%v", id, k, v)
+					return
+				}
+			}
+			errs[id] = lsm.Close()
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
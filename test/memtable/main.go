@@ -0,0 +1,98 @@
+// 缓存区及读缓存实现的性能对比,含分片前后的并发查找: go run ./test/memtable
+package main
+
+import (
+	"fmt"
+	"github.com/hlccd/hlsm/cache"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+const entries = 100000
+
+var memtables = []struct {
+	name string
+	new  func() cache.Cache
+}{
+	{"lru", func() cache.Cache { return cache.NewLRU(1 << 40) }},
+	{"skiplist", func() cache.Cache { return cache.NewSkipList(1 << 40) }},
+	{"sharded-lru", func() cache.Cache {
+		return cache.NewSharded(32, 1<<40, func(cap int64) cache.Cache { return cache.NewLRU(cap) })
+	}},
+	{"readlru", func() cache.Cache { return cache.NewReadLRU(1<<40, nil) }},
+	{"sharded-readlru", func() cache.Cache {
+		return cache.NewSharded(32, 1<<40, func(cap int64) cache.Cache { return cache.NewReadLRU(cap, nil) })
+	}},
+}
+
+func keys() []string {
+	ks := make([]string, entries)
+	for i := range ks {
+		ks[i] = "key" + strconv.Itoa(rand.Int())
+	}
+	return ks
+}
+
+func filled(newCache func() cache.Cache, ks []string) cache.Cache {
+	c := newCache()
+	for _, k := range ks {
+		c.Insert(k, k)
+	}
+	return c
+}
+
+func main() {
+	ks := keys()
+	benchmarks := []struct {
+		name string
+		fn   func(newCache func() cache.Cache) func(b *testing.B)
+	}{
+		{"Insert", func(newCache func() cache.Cache) func(b *testing.B) {
+			return func(b *testing.B) {
+				c := newCache()
+				for i := 0; i < b.N; i++ {
+					c.Insert(ks[i%entries], i)
+				}
+			}
+		}},
+		{"ParallelGet", func(newCache func() cache.Cache) func(b *testing.B) {
+			return func(b *testing.B) {
+				c := filled(newCache, ks)
+				b.ResetTimer()
+				b.RunParallel(func(pb *testing.PB) {
+					i := rand.Intn(entries)
+					for pb.Next() {
+						c.Find(ks[i%entries])
+						i++
+					}
+				})
+			}
+		}},
+		{"Scan", func(newCache func() cache.Cache) func(b *testing.B) {
+			return func(b *testing.B) {
+				c := filled(newCache, ks)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					c.Scan("key1", "key2")
+				}
+			}
+		}},
+		{"ClearAndGainSorted", func(newCache func() cache.Cache) func(b *testing.B) {
+			return func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					c := filled(newCache, ks)
+					b.StartTimer()
+					c.ClearAndGainSorted()
+				}
+			}
+		}},
+	}
+	for _, bm := range benchmarks {
+		for _, m := range memtables {
+			r := testing.Benchmark(bm.fn(m.new))
+			fmt.Printf("%-20s %-16s %s\t%s\n", bm.name, m.name, r.String(), r.MemString())
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// 基于模型的检查,以随机的写入、删除、范围删除及批量写入操作数据库,同时在映射表上执行相同的操作,
+// 期间穿插落盘、压缩及重新打开,检查数据库读出的内容始终与映射表一致,
+// key 空间很小,同一 key 会在多个区块中反复出现,用于检查合并时以最新的版本为准: go run ./test/model
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/hlccd/hlsm"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+)
+
+const keys = 500
+
+var (
+	seeds = flag.Int("seeds", 4, "每种配置运行的随机种子数量")
+	ops   = flag.Int("ops", 20000, "每次运行的操作数量")
+)
+
+func main() {
+	flag.Parse()
+	log.SetOutput(ioutil.Discard)
+	configs := []hlsm.Options{
+		{Compaction: hlsm.LeveledCompaction, Subcompactions: 1, Memtable: hlsm.LRUMemtable},
+		{Compaction: hlsm.LeveledCompaction, Subcompactions: 3, Memtable: hlsm.LRUMemtable},
+		{Compaction: hlsm.TieredCompaction, Subcompactions: 1, Memtable: hlsm.LRUMemtable},
+		{Compaction: hlsm.LeveledCompaction, Subcompactions: 1, Memtable: hlsm.SkipListMemtable},
+	}
+	failed := 0
+	for _, opts := range configs {
+		opts.CapMin = 2 * hlsm.KB
+		opts.CapMax = 32 * hlsm.KB
+		for seed := int64(1); seed <= int64(*seeds); seed++ {
+			if err := run(opts, seed); err != nil {
+				fmt.Printf("%-8s subcompactions=%d memtable=%-8s seed=%d 失败: %v\n",
+					opts.Compaction, opts.Subcompactions, opts.Memtable, seed, err)
+				failed++
+			}
+		}
+		fmt.Printf("%-8s subcompactions=%d memtable=%-8s 完成\n", opts.Compaction, opts.Subcompactions, opts.Memtable)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func key(r *rand.Rand) string {
+	return fmt.Sprintf("key%04d", r.Intn(keys))
+}
+
+// 执行随机操作,出现与映射表不一致时返回第一个差异
+func run(opts hlsm.Options, seed int64) error {
+	dir, err := ioutil.TempDir("", "hlsm-model")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lsm := hlsm.NewHLsmWithOptions(dir, opts)
+	r := rand.New(rand.NewSource(seed))
+	model := make(map[string]string, keys)
+	for i := 0; i < *ops; i++ {
+		switch x := r.Intn(100); {
+		case x < 50:
+			k, v := key(r), fmt.Sprintf("v%d", i)
+			lsm.Insert(k, v)
+			model[k] = v
+		case x < 70:
+			k := key(r)
+			lsm.Erase(k)
+			delete(model, k)
+		case x < 80:
+			// 删除后立即重新写入,或写入后立即删除,两者的先后不能在合并后颠倒
+			k, v := key(r), fmt.Sprintf("v%d", i)
+			if r.Intn(2) == 0 {
+				lsm.Erase(k)
+				lsm.Insert(k, v)
+				model[k] = v
+			} else {
+				lsm.Insert(k, v)
+				lsm.Erase(k)
+				delete(model, k)
+			}
+		case x < 85:
+			start, end := key(r), key(r)
+			if start > end {
+				start, end = end, start
+			}
+			lsm.DeleteRange(start, end)
+			for k := range model {
+				if k >= start && k < end {
+					delete(model, k)
+				}
+			}
+		case x < 95:
+			b := hlsm.NewWriteBatch()
+			f, _ := lsm.Family(hlsm.DefaultFamily)
+			for j := r.Intn(8); j >= 0; j-- {
+				k := key(r)
+				if r.Intn(3) == 0 {
+					b.Erase(f, k)
+					delete(model, k)
+				} else {
+					v := fmt.Sprintf("v%d.%d", i, j)
+					b.Insert(f, k, v)
+					model[k] = v
+				}
+			}
+			if err = lsm.Write(b); err != nil {
+				return err
+			}
+		case x < 97:
+			lsm.Compact()
+		case x < 98:
+			if err = lsm.CompactRange(key(r), key(r)).Wait(); err != nil && !errors.Is(err, hlsm.ErrTopBlocksSkipped) {
+				return err
+			}
+		default:
+			if err = lsm.Close(); err != nil {
+				return err
+			}
+			lsm = hlsm.NewHLsmWithOptions(dir, opts)
+		}
+		if i%2000 == 1999 {
+			if err = check(lsm, model, r); err != nil {
+				return fmt.Errorf("第 %d 次操作后: %v", i+1, err)
+			}
+		}
+	}
+	lsm.Compact()
+	if err = check(lsm, model, r); err != nil {
+		return fmt.Errorf("压缩后: %v", err)
+	}
+	if err = lsm.Close(); err != nil {
+		return err
+	}
+	lsm = hlsm.NewHLsmWithOptions(dir, opts)
+	if err = check(lsm, model, r); err != nil {
+		return fmt.Errorf("重新打开后: %v", err)
+	}
+	return lsm.Close()
+}
+
+// 检查每个 key 的查找结果、完整扫描及一个随机范围的扫描
+func check(lsm *hlsm.HLsm, model map[string]string, r *rand.Rand) error {
+	for i := 0; i < keys; i++ {
+		k := fmt.Sprintf("key%04d", i)
+		v, ok := lsm.Get(k)
+		want, exist := model[k]
+		if ok != exist || (ok && fmt.Sprint(v) != want) {
+			return fmt.Errorf("Get(%s) = %v, %v, 应为 %v, %v", k, v, ok, want, exist)
+		}
+	}
+	start, end := key(r), key(r)
+	if start > end {
+		start, end = end, start
+	}
+	for _, bound := range [][2]string{{"", ""}, {start, end}} {
+		got := lsm.Scan(bound[0], bound[1])
+		want := make([]string, 0)
+		for k := range model {
+			if k >= bound[0] && (bound[1] == "" || k < bound[1]) {
+				want = append(want, k)
+			}
+		}
+		sort.Strings(want)
+		if len(got) != len(want) {
+			return fmt.Errorf("Scan(%q, %q) 得到 %d 个元素,应为 %d 个", bound[0], bound[1], len(got), len(want))
+		}
+		for i, v := range got {
+			if v.Key != want[i] || fmt.Sprint(v.Value) != model[want[i]] {
+				return fmt.Errorf("Scan(%q, %q) 第 %d 个元素为 %s=%v,应为 %s=%s",
+					bound[0], bound[1], i, v.Key, v.Value, want[i], model[want[i]])
+			}
+		}
+	}
+	return nil
+}
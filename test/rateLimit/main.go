@@ -0,0 +1,76 @@
+// 落盘及压缩限速与后台压缩: 分别以不限速、限速及运行时调整限速的方式写入相同的数据,
+// 统计写入耗时、写入延迟的 p99 及硬盘写入速率,并检查数据完整: go run ./test/rateLimit
+package main
+
+import (
+	"fmt"
+	"github.com/hlccd/hlsm"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+const writes = 30000
+
+func main() {
+	log.SetOutput(ioutil.Discard)
+	ok := true
+	for _, c := range []struct {
+		name       string
+		opts       hlsm.Options
+		adjustRate int64 // 写入一半后调整的限速,为 0 时不调整
+	}{
+		{name: "unlimited", opts: hlsm.Options{}},
+		{name: "background", opts: hlsm.Options{BackgroundCompaction: true}},
+		{name: "limited", opts: hlsm.Options{RateLimit: 2 * hlsm.MB, BackgroundCompaction: true}},
+		{name: "adjusted", opts: hlsm.Options{RateLimit: 2 * hlsm.MB, BackgroundCompaction: true}, adjustRate: 1 * hlsm.MB},
+	} {
+		if !run(c.name, c.opts, c.adjustRate) {
+			ok = false
+		}
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+func run(name string, opts hlsm.Options, adjustRate int64) bool {
+	dir, err := ioutil.TempDir("", "hlsm-rate")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	opts.CapMin = 16 * hlsm.KB
+	opts.CapMax = 1 * hlsm.MB
+	lsm := hlsm.NewHLsmWithOptions(dir, opts)
+
+	latencies := make([]time.Duration, 0, writes)
+	start := time.Now()
+	for i := 0; i < writes; i++ {
+		if i == writes/2 && adjustRate > 0 {
+			lsm.SetRateLimit(adjustRate, 0)
+		}
+		begin := time.Now()
+		lsm.Insert(fmt.Sprintf("key%06d", i%10000), i)
+		latencies = append(latencies, time.Since(begin))
+	}
+	lsm.Compact()
+	elapse := time.Since(start)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	stats := lsm.WriteStats()
+	written := stats.Flushed + stats.Compacted
+	rate, _ := lsm.RateLimit()
+	bad := 0
+	for i := writes - 10000; i < writes; i++ {
+		if v, ok := lsm.Get(fmt.Sprintf("key%06d", i%10000)); !ok || fmt.Sprint(v) != fmt.Sprint(i) {
+			bad++
+		}
+	}
+	fmt.Printf("%-10s 耗时 %-12v p99 %-12v 写入 %6dKB %8.0fKB/s 限速 %5dKB/s 数据错误 %d\n",
+		name, elapse.Round(time.Millisecond), latencies[len(latencies)*99/100], written/hlsm.KB,
+		float64(written/hlsm.KB)/elapse.Seconds(), rate/hlsm.KB, bad)
+	return bad == 0
+}
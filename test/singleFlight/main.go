@@ -0,0 +1,234 @@
+// 单次请求的并发检查,应使用竞态检测运行: go run -race ./test/singleFlight
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/hlccd/hlsm/singleFlight"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const callers = 64
+
+func main() {
+	checks := []struct {
+		name string
+		fn   func() error
+	}{
+		{"Do 并发重复调用", checkDo},
+		{"DoChan 并发重复调用", checkDoChan},
+		{"panic 传递", checkPanic},
+		{"Forget", checkForget},
+		{"DoCtx 放弃等待", checkDoCtx},
+		{"DoCtx 全部放弃后重新请求", checkDoCtxRestart},
+	}
+	failed := false
+	for _, c := range checks {
+		if err := c.fn(); err != nil {
+			failed = true
+			fmt.Println("FAIL", c.name, err)
+		} else {
+			fmt.Println("ok  ", c.name)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func checkDo() error {
+	g := singleFlight.NewGroup[int]()
+	var calls int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	results := make([]int, callers)
+	shared := make([]bool, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, _, s := g.Do("key", func() (int, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return 42, nil
+			})
+			results[i], shared[i] = v, s
+		}(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		return fmt.Errorf("请求执行了 %d 次", calls)
+	}
+	for i := range results {
+		if results[i] != 42 || !shared[i] {
+			return fmt.Errorf("调用方 %d 的结果为 %d,shared: %v", i, results[i], shared[i])
+		}
+	}
+	return nil
+}
+
+func checkDoChan() error {
+	g := singleFlight.NewGroup[string]()
+	var calls int32
+	release := make(chan struct{})
+	errFn := errors.New("失败")
+	chans := make([]<-chan singleFlight.Result[string], callers)
+	for i := range chans {
+		chans[i] = g.DoChan("key", func() (string, error) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return "v", errFn
+		})
+	}
+	close(release)
+	for i, ch := range chans {
+		select {
+		case r := <-ch:
+			if r.Val != "v" || r.Err != errFn || !r.Shared {
+				return fmt.Errorf("调用方 %d 的结果为 %+v", i, r)
+			}
+		case <-time.After(time.Second):
+			return fmt.Errorf("调用方 %d 未收到结果", i)
+		}
+	}
+	if calls != 1 {
+		return fmt.Errorf("请求执行了 %d 次", calls)
+	}
+	return nil
+}
+
+func checkPanic() error {
+	g := singleFlight.NewGroup[int]()
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	var panics int32
+	fn := func() (int, error) {
+		<-release
+		panic("boom")
+	}
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					if _, ok := r.(*singleFlight.PanicError); ok {
+						atomic.AddInt32(&panics, 1)
+					}
+				}
+			}()
+			g.Do("key", fn)
+		}()
+	}
+	ch := g.DoChan("key", fn)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if panics != callers {
+		return fmt.Errorf("只有 %d 个调用方收到 panic", panics)
+	}
+	if r := <-ch; r.Err == nil {
+		return errors.New("DoChan 未收到 panic")
+	}
+	return nil
+}
+
+func checkForget() error {
+	g := singleFlight.NewGroup[int]()
+	release := make(chan struct{})
+	first := g.DoChan("key", func() (int, error) {
+		<-release
+		return 1, nil
+	})
+	g.Forget("key")
+	v, _, _ := g.Do("key", func() (int, error) {
+		return 2, nil
+	})
+	close(release)
+	if r := <-first; r.Val != 1 || v != 2 {
+		return fmt.Errorf("结果为 %d 和 %d", r.Val, v)
+	}
+	return nil
+}
+
+func checkDoCtx() error {
+	g := singleFlight.NewGroup[int]()
+	release := make(chan struct{})
+	cancelled := make(chan struct{})
+	fn := func(ctx context.Context) (int, error) {
+		select {
+		case <-release:
+			return 7, nil
+		case <-ctx.Done():
+			close(cancelled)
+			return 0, ctx.Err()
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	var abandoned int32
+	for i := 0; i < callers/2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err, _ := g.DoCtx(ctx, "key", fn); err == context.Canceled {
+				atomic.AddInt32(&abandoned, 1)
+			}
+		}()
+	}
+	var v int
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		v, _, _ = g.DoCtx(context.Background(), "key", fn)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-cancelled:
+		return errors.New("仍有调用方等待时请求被取消")
+	default:
+	}
+	close(release)
+	wg.Wait()
+	if v != 7 || abandoned != callers/2 {
+		return fmt.Errorf("结果为 %d,放弃等待的调用方 %d 个", v, abandoned)
+	}
+	return nil
+}
+
+func checkDoCtxRestart() error {
+	g := singleFlight.NewGroup[int]()
+	release := make(chan struct{})
+	defer close(release)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		_, err, _ := g.DoCtx(ctx, "key", func(ctx context.Context) (int, error) {
+			// 忽略取消,模拟迟迟不返回的请求
+			<-release
+			return 0, ctx.Err()
+		})
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-done; err != context.Canceled {
+		return fmt.Errorf("放弃等待返回 %v", err)
+	}
+	// 被取消的请求尚未返回,之后的调用方应重新发起请求
+	v, err, _ := g.DoCtx(context.Background(), "key", func(ctx context.Context) (int, error) {
+		return 9, nil
+	})
+	if v != 9 || err != nil {
+		return fmt.Errorf("重新请求的结果为 %d,%v", v, err)
+	}
+	return nil
+}
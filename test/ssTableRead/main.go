@@ -0,0 +1,61 @@
+// 多个协程并发读取同一个 SSTable 的性能,随并发数增加应接近线性扩展,
+// 分别测试 ReadAt 与内存映射两种读取方式: go run ./test/ssTableRead
+package main
+
+import (
+	"fmt"
+	"github.com/hlccd/hlsm/kv"
+	"github.com/hlccd/hlsm/ssTable"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+const entries = 100000
+
+func main() {
+	log.SetOutput(ioutil.Discard)
+	dir, err := ioutil.TempDir("", "hlsm-read")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keys := make([]string, entries)
+	values := make([]*kv.Value, entries)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key%08d", i)
+		values[i] = kv.NewValue(keys[i], strconv.Itoa(i), false)
+	}
+	for _, mmap := range []bool{false, true} {
+		tree := ssTable.NewTableTree(dir, 1<<40, 1<<40)
+		tree.SetMmap(mmap)
+		tree.Insert(values, nil, 0)
+		bench(tree, keys, mmap)
+		tree.Close()
+		_ = os.Remove(dir + "/0.0.db")
+	}
+}
+
+func bench(tree *ssTable.TableTree, keys []string, mmap bool) {
+	for _, procs := range []int{1, 2, 4, 8, 16} {
+		old := runtime.GOMAXPROCS(procs)
+		r := testing.Benchmark(func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				rnd := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					key := keys[rnd.Intn(entries)]
+					if _, ok := tree.Get(key); !ok {
+						b.Fatal("未能找到", key)
+					}
+				}
+			})
+		})
+		runtime.GOMAXPROCS(old)
+		fmt.Printf("ParallelGet mmap=%-5v procs=%-3d %s\t%s\n", mmap, procs, r.String(), r.MemString())
+	}
+}
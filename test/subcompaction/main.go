@@ -0,0 +1,77 @@
+// 子压缩: 以不同的子压缩数量写入相同的随机数据并完整压缩,检查结果与不拆分时完全相同,
+// 并比较写入(包括写入触发的压缩)的耗时: go run ./test/subcompaction
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/hlccd/hlsm"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+	"reflect"
+	"time"
+)
+
+const (
+	keys   = 50000
+	writes = 100000
+)
+
+func main() {
+	log.SetOutput(ioutil.Discard)
+	var want []string
+	ok := true
+	for _, n := range []int{1, 2, 4, 8} {
+		got, elapse := run(n)
+		same := want == nil || reflect.DeepEqual(got, want)
+		if want == nil {
+			want = got
+		}
+		fmt.Printf("subcompactions=%d 元素 %d 写入耗时 %-12v 与不拆分相同 %v\n", n, len(got), elapse.Round(time.Millisecond), same)
+		if !same {
+			ok = false
+		}
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// 写入随机数据后完整压缩,返回所有元素及写入的耗时
+func run(subcompactions int) ([]string, time.Duration) {
+	dir, err := ioutil.TempDir("", "hlsm-sub")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lsm := hlsm.NewHLsmWithOptions(dir, hlsm.Options{
+		CapMin:         64 * hlsm.KB,
+		CapMax:         4 * hlsm.MB,
+		Subcompactions: subcompactions,
+	})
+	r := rand.New(rand.NewSource(1))
+	start := time.Now()
+	for i := 0; i < writes; i++ {
+		key := fmt.Sprintf("key%06d", r.Intn(keys))
+		switch x := r.Intn(100); {
+		case x < 80:
+			lsm.Insert(key, fmt.Sprintf("value-%d-%0100d", i, i))
+		case x < 99:
+			lsm.Erase(key)
+		default:
+			lsm.DeleteRange(key, key+"5")
+		}
+	}
+	elapse := time.Since(start)
+	if err = lsm.CompactRange("", "").Wait(); err != nil && !errors.Is(err, hlsm.ErrTopBlocksSkipped) {
+		panic(err)
+	}
+	values := make([]string, 0)
+	for _, v := range lsm.Scan("", "") {
+		values = append(values, fmt.Sprint(v.Key, "=", v.Value))
+	}
+	return values, elapse
+}
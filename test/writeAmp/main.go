@@ -0,0 +1,84 @@
+// 各压缩策略的写放大,写入相同的随机数据后检查写放大符合各策略的预期:
+// 分级压缩小于分层压缩,先进先出从不合并故为 1,且未被删除的数据均可读出: go run ./test/writeAmp
+package main
+
+import (
+	"fmt"
+	"github.com/hlccd/hlsm"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"os"
+)
+
+const (
+	keys   = 20000
+	writes = 60000
+)
+
+func main() {
+	log.SetOutput(ioutil.Discard)
+	amp := make(map[hlsm.CompactionKind]float64)
+	ok := true
+	for _, kind := range []hlsm.CompactionKind{hlsm.LeveledCompaction, hlsm.TieredCompaction, hlsm.FIFOCompaction} {
+		wa, bad := run(kind)
+		amp[kind] = wa
+		fmt.Printf("%-8s 写放大 %.2f 数据错误 %d\n", kind, wa, bad)
+		if bad > 0 {
+			ok = false
+		}
+	}
+	if amp[hlsm.TieredCompaction] >= amp[hlsm.LeveledCompaction] {
+		fmt.Println("分级压缩的写放大应小于分层压缩")
+		ok = false
+	}
+	if amp[hlsm.FIFOCompaction] != 1 {
+		fmt.Println("先进先出的写放大应为 1")
+		ok = false
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// 写入随机数据,返回写放大及读出的值与预期不符的 key 数量,先进先出只检查最近写入的 key
+func run(kind hlsm.CompactionKind) (float64, int) {
+	dir, err := ioutil.TempDir("", "hlsm-wa")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lsm := hlsm.NewHLsmWithOptions(dir, hlsm.Options{
+		CapMin:      16 * hlsm.KB,
+		CapMax:      1 * hlsm.MB,
+		Compaction:  kind,
+		FIFOMaxSize: 1 * hlsm.MB,
+	})
+	r := rand.New(rand.NewSource(1))
+	model := make(map[string]int, keys)
+	recent := make([]string, 0, 1000)
+	for i := 0; i < writes; i++ {
+		key := fmt.Sprintf("key%06d", r.Intn(keys))
+		lsm.Insert(key, i)
+		model[key] = i
+		if i >= writes-cap(recent) {
+			recent = append(recent, key)
+		}
+	}
+	check := recent
+	if kind != hlsm.FIFOCompaction {
+		check = make([]string, 0, len(model))
+		for key := range model {
+			check = append(check, key)
+		}
+	}
+	bad := 0
+	for _, key := range check {
+		v, ok := lsm.Get(key)
+		if !ok || fmt.Sprint(v) != fmt.Sprint(model[key]) {
+			bad++
+		}
+	}
+	return lsm.WriteStats().WriteAmplification(), bad
+}
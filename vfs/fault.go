@@ -0,0 +1,348 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrInjected = errors.New("注入的写入失败")          // FailWrite 指定的写入返回的错误
+	ErrCrashed  = errors.New("文件在模拟崩溃前打开,已不可使用") // 模拟崩溃后,崩溃前打开的文件的所有操作返回的错误
+)
+
+// Fault 在另一个文件系统之上注入故障的文件系统,用于检查数据库在写入失败或崩溃后的行为,
+// 只有同步过的数据在崩溃后保留,创建、删除及重命名视为立即持久化,但从未同步过的新文件在崩溃后消失,
+// 清空已有文件同样视为立即持久化
+type Fault struct {
+	fs     FS
+	writes int64                 // 已执行的写入次数
+	failAt int64                 // 第几次写入返回 ErrInjected,为 0 时不注入
+	gen    int                   // 模拟崩溃的次数,文件只能在打开时的 gen 下使用
+	nodes  map[string]*faultNode // 以写入方式打开过的文件
+	locks  []io.Closer           // 当前持有的锁,模拟崩溃时释放
+	lock   sync.Mutex            // 并发控制锁
+}
+
+// 文件最近一次同步时的状态,重命名后依然由已打开的文件共享
+type faultNode struct {
+	synced int64 // 最近一次同步时的长度,为 -1 时自创建以来从未同步
+}
+
+// NewFault 在 fs 之上创建可注入故障的文件系统,初始时不注入任何故障
+func NewFault(fs FS) *Fault {
+	return &Fault{
+		fs:    fs,
+		nodes: make(map[string]*faultNode),
+	}
+}
+
+// FailWrite 从现在起的第 n 次写入返回 ErrInjected 且不写入任何数据,之后的写入恢复正常,n 小于等于 0 时取消
+func (fs *Fault) FailWrite(n int64) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if n <= 0 {
+		fs.failAt = 0
+		return
+	}
+	fs.failAt = fs.writes + n
+}
+
+// Writes 已执行的写入次数,包括失败的写入
+func (fs *Fault) Writes() int64 {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.writes
+}
+
+// DropUnsynced 丢弃所有尚未同步的数据,从未同步过的新文件被删除,其余文件截断到最近一次同步时的长度
+func (fs *Fault) DropUnsynced() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.dropUnsynced()
+}
+
+func (fs *Fault) dropUnsynced() error {
+	for name, node := range fs.nodes {
+		if node.synced < 0 {
+			if err := fs.fs.Remove(name); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			delete(fs.nodes, name)
+			continue
+		}
+		f, err := fs.fs.Append(name)
+		if err != nil {
+			return err
+		}
+		err = f.Truncate(node.synced)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Crash 模拟进程崩溃后重启:丢弃尚未同步的数据,释放所有锁,崩溃前打开的文件的所有操作返回 ErrCrashed,
+// 之后打开的文件可正常使用
+func (fs *Fault) Crash() error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.gen++
+	for _, l := range fs.locks {
+		_ = l.Close()
+	}
+	fs.locks = nil
+	return fs.dropUnsynced()
+}
+
+// 记录以写入方式打开的文件,size 为打开前的长度,调用方需持有锁
+func (fs *Fault) track(name string, size int64) *faultNode {
+	name = clean(name)
+	node, ok := fs.nodes[name]
+	if !ok {
+		node = &faultNode{synced: size}
+		fs.nodes[name] = node
+	}
+	return node
+}
+
+func (fs *Fault) wrap(f File, node *faultNode) File {
+	return &faultFile{fs: fs, f: f, node: node, gen: fs.gen}
+}
+
+func (fs *Fault) Open(name string) (File, error) {
+	f, err := fs.fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.wrap(f, nil), nil
+}
+
+func (fs *Fault) Create(name string) (File, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	size := int64(-1)
+	if _, err := fs.fs.Stat(name); err == nil {
+		size = 0
+	}
+	f, err := fs.fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if node, ok := fs.nodes[clean(name)]; ok && node.synced > 0 {
+		node.synced = 0
+	}
+	return fs.wrap(f, fs.track(name, size)), nil
+}
+
+func (fs *Fault) Append(name string) (File, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	size := int64(-1)
+	if info, err := fs.fs.Stat(name); err == nil {
+		size = info.Size()
+	}
+	f, err := fs.fs.Append(name)
+	if err != nil {
+		return nil, err
+	}
+	return fs.wrap(f, fs.track(name, size)), nil
+}
+
+func (fs *Fault) Remove(name string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if err := fs.fs.Remove(name); err != nil {
+		return err
+	}
+	delete(fs.nodes, clean(name))
+	return nil
+}
+
+func (fs *Fault) RemoveAll(name string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if err := fs.fs.RemoveAll(name); err != nil {
+		return err
+	}
+	name = clean(name)
+	delete(fs.nodes, name)
+	for p := range fs.nodes {
+		if strings.HasPrefix(p, name+"/") {
+			delete(fs.nodes, p)
+		}
+	}
+	return nil
+}
+
+func (fs *Fault) Rename(oldName, newName string) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if err := fs.fs.Rename(oldName, newName); err != nil {
+		return err
+	}
+	oldName, newName = clean(oldName), clean(newName)
+	delete(fs.nodes, newName)
+	if node, ok := fs.nodes[oldName]; ok {
+		delete(fs.nodes, oldName)
+		fs.nodes[newName] = node
+	}
+	for p, node := range fs.nodes {
+		if strings.HasPrefix(p, oldName+"/") {
+			delete(fs.nodes, p)
+			fs.nodes[newName+"/"+p[len(oldName)+1:]] = node
+		}
+	}
+	return nil
+}
+
+func (fs *Fault) Mkdir(name string, perm os.FileMode) error {
+	return fs.fs.Mkdir(name, perm)
+}
+
+func (fs *Fault) MkdirAll(name string, perm os.FileMode) error {
+	return fs.fs.MkdirAll(name, perm)
+}
+
+func (fs *Fault) ReadDir(name string) ([]os.FileInfo, error) {
+	return fs.fs.ReadDir(name)
+}
+
+func (fs *Fault) Stat(name string) (os.FileInfo, error) {
+	return fs.fs.Stat(name)
+}
+
+func (fs *Fault) Lock(name string) (io.Closer, error) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	l, err := fs.fs.Lock(name)
+	if err != nil {
+		return nil, err
+	}
+	fs.locks = append(fs.locks, l)
+	return &faultLock{fs: fs, l: l, gen: fs.gen}, nil
+}
+
+type faultLock struct {
+	fs  *Fault
+	l   io.Closer
+	gen int
+}
+
+func (l *faultLock) Close() error {
+	l.fs.lock.Lock()
+	defer l.fs.lock.Unlock()
+	if l.gen != l.fs.gen {
+		// 已在模拟崩溃时释放
+		return ErrCrashed
+	}
+	for i, held := range l.fs.locks {
+		if held == l.l {
+			l.fs.locks = append(l.fs.locks[:i], l.fs.locks[i+1:]...)
+			break
+		}
+	}
+	return l.l.Close()
+}
+
+// 可注入故障的文件系统中打开的文件
+type faultFile struct {
+	fs   *Fault
+	f    File
+	node *faultNode // 以只读方式打开时为 nil
+	gen  int
+}
+
+// 文件是否在模拟崩溃前打开
+func (f *faultFile) crashed() bool {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	return f.gen != f.fs.gen
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if f.crashed() {
+		return 0, ErrCrashed
+	}
+	return f.f.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.crashed() {
+		return 0, ErrCrashed
+	}
+	return f.f.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	fs := f.fs
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if f.gen != fs.gen {
+		return 0, ErrCrashed
+	}
+	fs.writes++
+	if fs.writes == fs.failAt {
+		fs.failAt = 0
+		return 0, ErrInjected
+	}
+	return f.f.Write(p)
+}
+
+func (f *faultFile) Seek(offset int64, whence int) (int64, error) {
+	if f.crashed() {
+		return 0, ErrCrashed
+	}
+	return f.f.Seek(offset, whence)
+}
+
+func (f *faultFile) Close() error {
+	err := f.f.Close()
+	if f.crashed() {
+		return ErrCrashed
+	}
+	return err
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	if f.crashed() {
+		return nil, ErrCrashed
+	}
+	return f.f.Stat()
+}
+
+// 同步后记录文件当前的长度,崩溃时保留到该长度
+func (f *faultFile) Sync() error {
+	fs := f.fs
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if f.gen != fs.gen {
+		return ErrCrashed
+	}
+	if err := f.f.Sync(); err != nil {
+		return err
+	}
+	if f.node != nil {
+		info, err := f.f.Stat()
+		if err != nil {
+			return err
+		}
+		f.node.synced = info.Size()
+	}
+	return nil
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if f.crashed() {
+		return ErrCrashed
+	}
+	return f.f.Truncate(size)
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package vfs
+
+import (
+	"io"
+	"os"
+)
+
+// 其他平台暂不支持文件锁,只创建锁文件而不加锁
+func lockFile(name string) (io.Closer, error) {
+	return os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+}
@@ -0,0 +1,444 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 内存文件系统,文件内容保存在内存中,目录需先创建才能在其中创建文件,"." 与 "/" 始终存在
+type memFS struct {
+	files map[string]*memNode  // 文件路径与文件内容的映射表
+	dirs  map[string]time.Time // 目录路径与创建时间的映射表
+	locks map[string]bool      // 已加锁的锁文件
+	lock  sync.RWMutex         // 并发控制锁
+}
+
+// 文件内容,重命名后依然由已打开的文件共享
+type memNode struct {
+	data    []byte
+	modTime time.Time
+	sync.RWMutex
+}
+
+// NewMem 创建一个空的内存文件系统
+func NewMem() FS {
+	return &memFS{
+		files: make(map[string]*memNode),
+		dirs:  map[string]time.Time{".": time.Now(), "/": time.Now()},
+		locks: make(map[string]bool),
+	}
+}
+
+func pathError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// 上级目录是否存在,调用方需持有锁
+func (fs *memFS) parentExists(name string) bool {
+	_, ok := fs.dirs[path.Dir(name)]
+	return ok
+}
+
+func (fs *memFS) Open(name string) (File, error) {
+	name = clean(name)
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	node, ok := fs.files[name]
+	if !ok {
+		return nil, pathError("open", name, os.ErrNotExist)
+	}
+	return &memFile{name: name, node: node, readOnly: true}, nil
+}
+
+func (fs *memFS) Create(name string) (File, error) {
+	return fs.openFile("create", name, true, false)
+}
+
+func (fs *memFS) Append(name string) (File, error) {
+	return fs.openFile("append", name, false, true)
+}
+
+func (fs *memFS) openFile(op, name string, truncate, append bool) (File, error) {
+	name = clean(name)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if _, ok := fs.dirs[name]; ok {
+		return nil, pathError(op, name, errors.New("是一个目录"))
+	}
+	if !fs.parentExists(name) {
+		return nil, pathError(op, name, os.ErrNotExist)
+	}
+	node, ok := fs.files[name]
+	if !ok {
+		node = &memNode{modTime: time.Now()}
+		fs.files[name] = node
+	} else if truncate {
+		node.Lock()
+		node.data = nil
+		node.modTime = time.Now()
+		node.Unlock()
+	}
+	return &memFile{name: name, node: node, append: append}, nil
+}
+
+func (fs *memFS) Remove(name string) error {
+	name = clean(name)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if _, ok := fs.files[name]; ok {
+		delete(fs.files, name)
+		return nil
+	}
+	if _, ok := fs.dirs[name]; !ok {
+		return pathError("remove", name, os.ErrNotExist)
+	}
+	if len(fs.children(name)) > 0 {
+		return pathError("remove", name, errors.New("目录不为空"))
+	}
+	delete(fs.dirs, name)
+	return nil
+}
+
+func (fs *memFS) RemoveAll(name string) error {
+	name = clean(name)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	delete(fs.files, name)
+	delete(fs.dirs, name)
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	for p := range fs.files {
+		if strings.HasPrefix(p, prefix) {
+			delete(fs.files, p)
+		}
+	}
+	for p := range fs.dirs {
+		if p != "/" && strings.HasPrefix(p, prefix) {
+			delete(fs.dirs, p)
+		}
+	}
+	return nil
+}
+
+func (fs *memFS) Rename(oldName, newName string) error {
+	oldName, newName = clean(oldName), clean(newName)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if !fs.parentExists(newName) {
+		return pathError("rename", newName, os.ErrNotExist)
+	}
+	if _, ok := fs.dirs[newName]; ok {
+		return pathError("rename", newName, errors.New("目标是一个目录"))
+	}
+	if node, ok := fs.files[oldName]; ok {
+		delete(fs.files, oldName)
+		fs.files[newName] = node
+		return nil
+	}
+	created, ok := fs.dirs[oldName]
+	if !ok {
+		return pathError("rename", oldName, os.ErrNotExist)
+	}
+	if _, ok = fs.files[newName]; ok {
+		return pathError("rename", newName, os.ErrExist)
+	}
+	// 移动目录及其中的所有内容
+	prefix := oldName + "/"
+	for p, node := range fs.files {
+		if strings.HasPrefix(p, prefix) {
+			delete(fs.files, p)
+			fs.files[newName+"/"+p[len(prefix):]] = node
+		}
+	}
+	for p, t := range fs.dirs {
+		if strings.HasPrefix(p, prefix) {
+			delete(fs.dirs, p)
+			fs.dirs[newName+"/"+p[len(prefix):]] = t
+		}
+	}
+	delete(fs.dirs, oldName)
+	fs.dirs[newName] = created
+	return nil
+}
+
+func (fs *memFS) Mkdir(name string, perm os.FileMode) error {
+	name = clean(name)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if _, ok := fs.dirs[name]; ok {
+		return pathError("mkdir", name, os.ErrExist)
+	}
+	if _, ok := fs.files[name]; ok {
+		return pathError("mkdir", name, os.ErrExist)
+	}
+	if !fs.parentExists(name) {
+		return pathError("mkdir", name, os.ErrNotExist)
+	}
+	fs.dirs[name] = time.Now()
+	return nil
+}
+
+func (fs *memFS) MkdirAll(name string, perm os.FileMode) error {
+	name = clean(name)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for p := name; ; p = path.Dir(p) {
+		if _, ok := fs.files[p]; ok {
+			return pathError("mkdir", p, errors.New("不是一个目录"))
+		}
+		if _, ok := fs.dirs[p]; ok {
+			break
+		}
+		fs.dirs[p] = time.Now()
+	}
+	return nil
+}
+
+// 目录中的直接子项,调用方需持有锁
+func (fs *memFS) children(name string) []os.FileInfo {
+	infos := make([]os.FileInfo, 0)
+	for p, node := range fs.files {
+		if path.Dir(p) == name {
+			node.RLock()
+			infos = append(infos, &memInfo{name: path.Base(p), size: int64(len(node.data)), modTime: node.modTime})
+			node.RUnlock()
+		}
+	}
+	for p, t := range fs.dirs {
+		if p != name && path.Dir(p) == name {
+			infos = append(infos, &memInfo{name: path.Base(p), modTime: t, dir: true})
+		}
+	}
+	return infos
+}
+
+func (fs *memFS) ReadDir(name string) ([]os.FileInfo, error) {
+	name = clean(name)
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	if _, ok := fs.dirs[name]; !ok {
+		return nil, pathError("readdir", name, os.ErrNotExist)
+	}
+	infos := fs.children(name)
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name() < infos[j].Name()
+	})
+	return infos, nil
+}
+
+func (fs *memFS) Stat(name string) (os.FileInfo, error) {
+	name = clean(name)
+	fs.lock.RLock()
+	defer fs.lock.RUnlock()
+	if node, ok := fs.files[name]; ok {
+		return node.info(name), nil
+	}
+	if t, ok := fs.dirs[name]; ok {
+		return &memInfo{name: path.Base(name), modTime: t, dir: true}, nil
+	}
+	return nil, pathError("stat", name, os.ErrNotExist)
+}
+
+func (fs *memFS) Lock(name string) (io.Closer, error) {
+	f, err := fs.Append(name)
+	if err != nil {
+		return nil, err
+	}
+	_ = f.Close()
+	name = clean(name)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.locks[name] {
+		return nil, errors.New("文件已被锁定: " + name)
+	}
+	fs.locks[name] = true
+	return &memLock{fs: fs, name: name}, nil
+}
+
+type memLock struct {
+	fs   *memFS
+	name string
+	once sync.Once
+}
+
+func (l *memLock) Close() error {
+	l.once.Do(func() {
+		l.fs.lock.Lock()
+		delete(l.fs.locks, l.name)
+		l.fs.lock.Unlock()
+	})
+	return nil
+}
+
+func (node *memNode) info(name string) os.FileInfo {
+	node.RLock()
+	defer node.RUnlock()
+	return &memInfo{name: path.Base(name), size: int64(len(node.data)), modTime: node.modTime}
+}
+
+// 内存文件系统中打开的文件
+type memFile struct {
+	name     string
+	node     *memNode
+	offset   int64 // 读写位置
+	readOnly bool  // 是否以只读方式打开
+	append   bool  // 写入是否总是追加到末尾
+	closed   bool
+	lock     sync.Mutex // 保护读写位置
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	n, err := f.readAt(p, f.offset)
+	f.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.lock.Lock()
+	closed := f.closed
+	f.lock.Unlock()
+	if closed {
+		return 0, os.ErrClosed
+	}
+	return f.readAt(p, off)
+}
+
+func (f *memFile) readAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, pathError("read", f.name, errors.New("偏移量为负"))
+	}
+	f.node.RLock()
+	defer f.node.RUnlock()
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if f.readOnly {
+		return 0, pathError("write", f.name, errors.New("文件以只读方式打开"))
+	}
+	f.node.Lock()
+	defer f.node.Unlock()
+	if f.append {
+		f.offset = int64(len(f.node.data))
+	}
+	end := f.offset + int64(len(p))
+	if size := int64(len(f.node.data)); end > size {
+		if end > int64(cap(f.node.data)) {
+			data := make([]byte, end, end*2)
+			copy(data, f.node.data)
+			f.node.data = data
+		} else {
+			f.node.data = f.node.data[:end]
+			// 写入位置在末尾之后时,中间的部分为 0
+			for i := size; i < f.offset; i++ {
+				f.node.data[i] = 0
+			}
+		}
+	}
+	copy(f.node.data[f.offset:], p)
+	f.offset = end
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		f.node.RLock()
+		offset += int64(len(f.node.data))
+		f.node.RUnlock()
+	}
+	if offset < 0 {
+		return 0, pathError("seek", f.name, errors.New("偏移量为负"))
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	return f.node.info(f.name), nil
+}
+
+// 内容已在内存中,无需同步
+func (f *memFile) Sync() error {
+	return nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	if f.readOnly {
+		return pathError("truncate", f.name, errors.New("文件以只读方式打开"))
+	}
+	f.node.Lock()
+	defer f.node.Unlock()
+	if size < int64(len(f.node.data)) {
+		f.node.data = f.node.data[:size]
+	} else {
+		data := make([]byte, size)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+	f.node.modTime = time.Now()
+	return nil
+}
+
+// 内存文件系统中的文件信息
+type memInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (info *memInfo) Name() string       { return info.name }
+func (info *memInfo) Size() int64        { return info.size }
+func (info *memInfo) ModTime() time.Time { return info.modTime }
+func (info *memInfo) IsDir() bool        { return info.dir }
+func (info *memInfo) Sys() any           { return nil }
+func (info *memInfo) Mode() os.FileMode {
+	if info.dir {
+		return os.ModeDir | 0777
+	}
+	return 0666
+}
@@ -0,0 +1,71 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"path"
+)
+
+/*
+虚拟文件系统:
+数据库及区块树对硬盘的所有读写均通过 FS 进行,默认为直接读写硬盘的 OS(),
+NewMem() 将所有文件保存在内存中,NewFault 在另一个文件系统之上注入故障,
+可使第 N 次写入失败、丢弃尚未同步的数据或模拟崩溃,用于检查数据库在故障下的行为
+*/
+
+// File 打开的文件,*os.File 即为一种实现
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// FS 文件系统,路径均使用 / 分隔
+type FS interface {
+	Open(name string) (File, error)               // 以只读方式打开
+	Create(name string) (File, error)             // 以读写方式打开,不存在时创建,存在时清空
+	Append(name string) (File, error)             // 以读写方式打开,写入总是追加到末尾,不存在时创建
+	Remove(name string) error                     // 删除文件或空目录
+	RemoveAll(name string) error                  // 删除文件或目录及其中的所有内容,不存在时不报错
+	Rename(oldName, newName string) error         // 重命名,目标存在时替换
+	Mkdir(name string, perm os.FileMode) error    // 创建目录,上级目录需存在
+	MkdirAll(name string, perm os.FileMode) error // 创建目录及所有不存在的上级目录
+	ReadDir(name string) ([]os.FileInfo, error)   // 目录中的所有文件及子目录,按名称排列
+	Stat(name string) (os.FileInfo, error)        // 文件或目录的信息
+	Lock(name string) (io.Closer, error)          // 以 name 为锁文件独占加锁,已被锁定时返回错误,关闭返回值即解锁
+}
+
+// ReadFile 读取文件的全部内容
+func ReadFile(fs FS, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// WriteFile 以 data 替换文件的内容并同步到存储
+func WriteFile(fs FS, name string, data []byte) error {
+	f, err := fs.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// 统一路径的写法,作为内存文件系统中的键
+func clean(name string) string {
+	return path.Clean(name)
+}